@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// catalogTTL is how long cached API listings are served without refetching.
+const catalogTTL = 24 * time.Hour
+
+// catalogPath holds public listings only. It belongs to the invoking user
+// even under sudo, so that completion in their own shell can read it.
+var catalogPath = cacheHome() + "/norrvpn"
+
+func cacheHome() string {
+	if dir := os.Getenv("XDG_CACHE_HOME"); dir != "" {
+		return dir
+	}
+	return getHomeDir() + "/.cache"
+}
+
+// fetchCached decodes the JSON document at url into v, serving it from the
+// on-disk catalog while the copy is younger than catalogTTL. A stale copy is
+// preferred over failing when the API cannot be reached.
+func fetchCached(url, name string, v any) error {
+	path := catalogPath + "/" + name
+	if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) < catalogTTL {
+		if data, err := os.ReadFile(path); err == nil && json.Unmarshal(data, v) == nil {
+			return nil
+		}
+	}
+
+	data, err := httpGet(url)
+	if err == nil {
+		err = json.Unmarshal(data, v)
+	}
+	if err != nil {
+		if stale, rerr := os.ReadFile(path); rerr == nil && json.Unmarshal(stale, v) == nil {
+			return nil
+		}
+		return err
+	}
+	writeCatalogFile(path, data)
+	return nil
+}
+
+// writeCatalogFile writes into catalogPath, creating it and handing what it
+// creates to the user behind sudo.
+func writeCatalogFile(path string, data []byte) {
+	uid, gid := invokingUser()
+	var created []string
+	for dir := catalogPath; dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+		if _, err := os.Stat(dir); err == nil {
+			break
+		}
+		created = append(created, dir)
+	}
+	if os.MkdirAll(catalogPath, 0755) != nil {
+		return
+	}
+	_, err := os.Stat(path)
+	if os.WriteFile(path, data, 0644) != nil || uid == os.Geteuid() {
+		return
+	}
+	if os.IsNotExist(err) {
+		created = append(created, path)
+	}
+	for _, name := range created {
+		os.Lchown(name, uid, gid)
+	}
+}
+
+func httpGet(url string) ([]byte, error) {
+	resp, err := apiClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// catalogServer is the slim per-server record kept for completion.
+type catalogServer struct {
+	Hostname string `json:"hostname"`
+	Country  string `json:"country"`
+	City     string `json:"city"`
+	Load     int    `json:"load"`
+}
+
+// rememberServers merges servers seen in API responses into the catalog.
+func rememberServers(servers Servers) {
+	if len(servers) == 0 {
+		return
+	}
+	known := map[string]catalogServer{}
+	for _, server := range cachedServers() {
+		known[server.Hostname] = server
+	}
+	for _, server := range servers {
+		entry := catalogServer{Hostname: server.Hostname, Load: server.Load}
+		if len(server.Locations) > 0 {
+			entry.Country = strings.ToLower(server.Locations[0].Country.Code)
+			entry.City = server.Locations[0].Country.City.Name
+		}
+		known[server.Hostname] = entry
+	}
+
+	list := make([]catalogServer, 0, len(known))
+	for _, server := range known {
+		list = append(list, server)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Hostname < list[j].Hostname })
+	data, err := json.Marshal(list)
+	if err != nil {
+		return
+	}
+	writeCatalogFile(catalogPath+"/servers.json", data)
+}
+
+func cachedServers() []catalogServer {
+	var list []catalogServer
+	if data, err := os.ReadFile(catalogPath + "/servers.json"); err == nil {
+		json.Unmarshal(data, &list)
+	}
+	return list
+}
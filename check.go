@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	defaultCheckIPURL = "https://api.ipify.org"
+	defaultCheckDest  = "1.1.1.1"
+	// checkIPv6Dest is dialled to see whether IPv6 bypasses the tunnel.
+	checkIPv6Dest = "[2606:4700:4700::1111]:443"
+	// checkTimeout bounds the exit IP request; a broken tunnel would
+	// otherwise hang it for minutes.
+	checkTimeout = 10 * time.Second
+)
+
+type checkStatus string
+
+const (
+	checkPass checkStatus = "PASS"
+	checkWarn checkStatus = "WARN"
+	checkFail checkStatus = "FAIL"
+	checkSkip checkStatus = "SKIP"
+)
+
+// checkResult is one line of check or doctor output.
+type checkResult struct {
+	name   string
+	status checkStatus
+	detail string
+	fix    string // suggested fix for failures and warnings
+}
+
+// printChecks prints results aligned by name and returns how many failed.
+func printChecks(results []checkResult) int {
+	width, failed := 0, 0
+	for _, r := range results {
+		width = max(width, len(r.name))
+	}
+	for _, r := range results {
+		fmt.Printf("%-4s  %-*s  %s\n", r.status, width, r.name, r.detail)
+		if r.fix != "" && (r.status == checkFail || r.status == checkWarn) {
+			fmt.Printf("      %-*s  fix: %s\n", width, "", r.fix)
+		}
+		if r.status == checkFail {
+			failed++
+		}
+	}
+	return failed
+}
+
+func newCheckCommand() *command {
+	cmd := newCommand("check", "", "Check the exit IP and look for DNS and IPv6 leaks")
+	cmd.maxArgs = 0
+	ipURL := cmd.flags.String("ip-url", "", "URL returning the public IP as plain text (default "+defaultCheckIPURL+")")
+	dest := cmd.flags.String("dest", defaultCheckDest, "Destination whose route must go through the tunnel")
+	cmd.run = func([]string) error {
+		iface := activeInterface()
+		if iface == "" {
+			return fmt.Errorf("not connected")
+		}
+		url := *ipURL
+		if url == "" {
+			cfg, err := loadConfig()
+			if err != nil {
+				return err
+			}
+			url = cfg.CheckIPURL
+		}
+		if url == "" {
+			url = defaultCheckIPURL
+		}
+
+		results := []checkResult{checkRoute(iface, *dest), checkExitIP(url)}
+		results = append(results, checkDNS(iface)...)
+		results = append(results, checkIPv6(iface))
+		if failed := printChecks(results); failed > 0 {
+			return fmt.Errorf("%d of %d checks failed", failed, len(results))
+		}
+		return nil
+	}
+	return cmd
+}
+
+// routeDevice returns the interface the kernel routes dest through.
+func routeDevice(dest string) (string, error) {
+	args := []string{"route", "get", dest}
+	if strings.Contains(dest, ":") {
+		args = append([]string{"-6"}, args...)
+	}
+	out, err := exec.Command("ip", args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%s", trim(string(out)))
+	}
+	fields := strings.Fields(string(out))
+	for i, field := range fields {
+		if field == "dev" && i+1 < len(fields) {
+			return fields[i+1], nil
+		}
+	}
+	return "", fmt.Errorf("no device in %q", trim(string(out)))
+}
+
+func checkRoute(iface, dest string) checkResult {
+	result := checkResult{name: "route"}
+	dev, err := routeDevice(dest)
+	switch {
+	case err != nil:
+		result.status, result.detail = checkFail, fmt.Sprintf("route to %s: %v", dest, err)
+	case dev != iface:
+		result.status, result.detail = checkFail, fmt.Sprintf("%s goes via %s instead of %s", dest, dev, iface)
+		result.fix = "sudo norrvpn repair"
+	default:
+		result.status, result.detail = checkPass, fmt.Sprintf("%s goes via %s", dest, iface)
+	}
+	return result
+}
+
+func checkExitIP(url string) checkResult {
+	result := checkResult{name: "exit ip"}
+	server, err := loadServerInfo()
+	if err != nil || server.Station == "" {
+		result.status, result.detail = checkSkip, "server details not available"
+		return result
+	}
+	data, err := publicIP(url)
+	if err != nil {
+		result.status, result.detail = checkFail, err.Error()
+		return result
+	}
+	ip := trim(string(data))
+	if net.ParseIP(ip) == nil {
+		result.status, result.detail = checkFail, fmt.Sprintf("%s did not return an IP address", url)
+		return result
+	}
+	if ip != server.Station {
+		result.status = checkFail
+		result.detail = fmt.Sprintf("public IP is %s, expected %s of %s", ip, server.Station, server.Hostname)
+		return result
+	}
+	result.status, result.detail = checkPass, fmt.Sprintf("public IP is %s (%s)", ip, server.Hostname)
+	return result
+}
+
+// publicIP asks url for the public IP address, giving up after
+// checkTimeout.
+func publicIP(url string) ([]byte, error) {
+	client := &http.Client{Timeout: checkTimeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1024))
+}
+
+// checkDNS looks at where DNS queries go: resolvers in resolv.conf must be
+// routed through the tunnel, and systemd-resolved must not have servers on
+// other links, as it sends those queries bound to the link and so around the
+// routing rules.
+func checkDNS(iface string) []checkResult {
+	var results []checkResult
+	nameservers := resolvConfServers()
+	stub := false
+	for _, ns := range nameservers {
+		ip := net.ParseIP(ns)
+		if ip == nil {
+			continue
+		}
+		if ip.IsLoopback() {
+			stub = true
+			continue
+		}
+		results = append(results, checkDNSServer(iface, ns, "resolv.conf"))
+	}
+
+	if stub {
+		links, global, err := resolvedServers()
+		if err != nil {
+			results = append(results, checkResult{name: "dns", status: checkWarn,
+				detail: "local resolver in resolv.conf, but its upstream servers are unknown: " + err.Error()})
+		}
+		for _, ns := range global {
+			results = append(results, checkDNSServer(iface, ns, "systemd-resolved"))
+		}
+		for link, servers := range links {
+			if link == iface {
+				continue
+			}
+			results = append(results, checkResult{name: "dns", status: checkFail,
+				detail: fmt.Sprintf("systemd-resolved sends queries to %s via %s, outside the tunnel", strings.Join(servers, " "), link),
+				fix:    fmt.Sprintf("resolvectl dns %s 103.86.96.100 && resolvectl domain %s '~.'", iface, iface)})
+		}
+	}
+	if len(results) == 0 {
+		results = append(results, checkResult{name: "dns", status: checkWarn, detail: "no DNS servers found"})
+	}
+	return results
+}
+
+func checkDNSServer(iface, ns, source string) checkResult {
+	result := checkResult{name: "dns"}
+	dev, err := routeDevice(ns)
+	switch {
+	case err != nil:
+		result.status, result.detail = checkWarn, fmt.Sprintf("%s from %s: %v", ns, source, err)
+	case dev != iface:
+		result.status = checkFail
+		result.detail = fmt.Sprintf("queries to %s from %s go via %s, outside the tunnel", ns, source, dev)
+		result.fix = "use a resolver reached through the tunnel, e.g. 103.86.96.100"
+	default:
+		result.status, result.detail = checkPass, fmt.Sprintf("queries to %s from %s go via %s", ns, source, iface)
+	}
+	return result
+}
+
+func resolvConfServers() []string {
+	file, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	var servers []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			servers = append(servers, fields[1])
+		}
+	}
+	return servers
+}
+
+// resolvedServers parses `resolvectl dns` into servers per link and global
+// servers.
+func resolvedServers() (map[string][]string, []string, error) {
+	out, err := exec.Command("resolvectl", "dns").Output()
+	if err != nil {
+		return nil, nil, err
+	}
+	links := map[string][]string{}
+	var global []string
+	for _, line := range strings.Split(string(out), "\n") {
+		name, list, ok := strings.Cut(line, ":")
+		servers := strings.Fields(list)
+		if !ok || len(servers) == 0 {
+			continue
+		}
+		if name == "Global" {
+			global = servers
+			continue
+		}
+		// "Link 2 (eth0)"
+		if open := strings.Index(name, "("); open >= 0 && strings.HasSuffix(name, ")") {
+			links[name[open+1:len(name)-1]] = servers
+		}
+	}
+	return links, global, nil
+}
+
+// checkIPv6 fails when IPv6 traffic can leave outside the tunnel, which only
+// carries IPv4.
+func checkIPv6(iface string) checkResult {
+	result := checkResult{name: "ipv6"}
+	host, _, _ := net.SplitHostPort(checkIPv6Dest)
+	dev, err := routeDevice(host)
+	if err != nil {
+		result.status, result.detail = checkPass, "no IPv6 route"
+		return result
+	}
+	if dev == iface {
+		result.status, result.detail = checkPass, "IPv6 goes via "+iface
+		return result
+	}
+	conn, err := net.DialTimeout("tcp6", checkIPv6Dest, 3*time.Second)
+	if err != nil {
+		result.status = checkPass
+		result.detail = fmt.Sprintf("IPv6 route via %s, but %s is not reachable", dev, host)
+		return result
+	}
+	conn.Close()
+	result.status = checkFail
+	result.detail = fmt.Sprintf("IPv6 reaches %s via %s, outside the tunnel", host, dev)
+	result.fix = "sysctl -w net.ipv6.conf.all.disable_ipv6=1"
+	return result
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// command is a single norrvpn subcommand with its own flag set.
+type command struct {
+	name    string
+	args    string // positional synopsis shown in help, e.g. "[cc] [city]"
+	summary string
+	minArgs int
+	maxArgs int // -1 means unlimited
+	hidden  bool
+	rawArgs bool // pass arguments to run without flag parsing
+	flags   *flag.FlagSet
+	run     func(args []string) error
+
+	// completeArgs and completeFlags suggest positional arguments and flag
+	// values for shell completion; either may be nil.
+	completeArgs  completer
+	completeFlags map[string]completer
+}
+
+// usageError is returned for invalid invocations; it makes main print the
+// command help hint and exit with status 2.
+type usageError struct {
+	cmd *command
+	msg string
+}
+
+func (e *usageError) Error() string {
+	return e.msg
+}
+
+func newCommand(name, args, summary string) *command {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	return &command{
+		name:          name,
+		args:          args,
+		summary:       summary,
+		maxArgs:       -1,
+		flags:         fs,
+		completeFlags: map[string]completer{},
+	}
+}
+
+func (c *command) usagef(format string, a ...any) error {
+	return &usageError{cmd: c, msg: fmt.Sprintf(format, a...)}
+}
+
+// parse parses flags and positional arguments in any order. Everything after
+// "--" is positional.
+func (c *command) parse(args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := c.flags.Parse(args); err != nil {
+			if errors.Is(err, flag.ErrHelp) {
+				return nil, err
+			}
+			return nil, c.usagef("%v", err)
+		}
+		rest := c.flags.Args()
+		if len(rest) == 0 {
+			break
+		}
+		if consumed := len(args) - len(rest); consumed > 0 && args[consumed-1] == "--" {
+			positional = append(positional, rest...)
+			break
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+
+	if len(positional) < c.minArgs {
+		return nil, c.usagef("%s: not enough arguments", c.name)
+	}
+	if c.maxArgs >= 0 && len(positional) > c.maxArgs {
+		return nil, c.usagef("%s: too many arguments", c.name)
+	}
+	return positional, nil
+}
+
+func (c *command) execute(args []string) error {
+	if c.rawArgs {
+		return c.run(args)
+	}
+	positional, err := c.parse(args)
+	if errors.Is(err, flag.ErrHelp) {
+		fmt.Println(c.help())
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return c.run(positional)
+}
+
+func (c *command) synopsis() string {
+	s := c.name
+	if hasFlags(c.flags) {
+		s += " [flags]"
+	}
+	if c.args != "" {
+		s += " " + c.args
+	}
+	return s
+}
+
+func (c *command) help() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Usage: norrvpn %s\n\n%s\n", c.synopsis(), c.summary)
+	if hasFlags(c.flags) {
+		b.WriteString("\nFlags:\n")
+		b.WriteString(flagHelp(c.flags))
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
+
+// flagSet reports whether the flag was given on the command line.
+func flagSet(fs *flag.FlagSet, name string) bool {
+	found := false
+	fs.Visit(func(f *flag.Flag) { found = found || f.Name == name })
+	return found
+}
+
+func hasFlags(fs *flag.FlagSet) bool {
+	found := false
+	fs.VisitAll(func(*flag.Flag) { found = true })
+	return found
+}
+
+// flagHelp renders flags in the same two-column layout as helpText.
+func flagHelp(fs *flag.FlagSet) string {
+	var names, usages []string
+	width := 0
+	fs.VisitAll(func(f *flag.Flag) {
+		kind, usage := flag.UnquoteUsage(f)
+		name := "--" + f.Name
+		if kind != "" {
+			name += " " + kind
+		}
+		switch f.DefValue {
+		case "", "false", "0", "0s":
+		default:
+			usage += fmt.Sprintf(" (default %s)", f.DefValue)
+		}
+		names = append(names, name)
+		usages = append(usages, usage)
+		width = max(width, len(name))
+	})
+
+	var b strings.Builder
+	for i := range names {
+		fmt.Fprintf(&b, "  %-*s  %s\n", width, names[i], usages[i])
+	}
+	return b.String()
+}
+
+var commands []*command
+
+func findCommand(name string) *command {
+	for _, c := range commands {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func commandHelp() string {
+	var b strings.Builder
+	width := 0
+	for _, c := range commands {
+		if !c.hidden {
+			width = max(width, len(c.name+" "+c.args))
+		}
+	}
+	for _, c := range commands {
+		if !c.hidden {
+			fmt.Fprintf(&b, "  %-*s  %s\n", width, strings.TrimSpace(c.name+" "+c.args), c.summary)
+		}
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
+
+func usage() string {
+	return fmt.Sprintf(helpText, commandHelp(), strings.TrimRight(flagHelp(flag.CommandLine), "\n"))
+}
+
+func newHelpCommand() *command {
+	cmd := newCommand("help", "[command]", "Show help for norrvpn or a command")
+	cmd.maxArgs = 1
+	cmd.completeArgs = func(ctx *completionContext) []string {
+		var names []string
+		for _, c := range commands {
+			if !c.hidden && len(ctx.args) == 0 {
+				names = append(names, c.name)
+			}
+		}
+		return names
+	}
+	cmd.run = func(args []string) error {
+		if len(args) == 0 {
+			fmt.Println(usage())
+			return nil
+		}
+		c := findCommand(args[0])
+		if c == nil {
+			return cmd.usagef("unknown command %q", args[0])
+		}
+		fmt.Println(c.help())
+		return nil
+	}
+	return cmd
+}
+
+// exitWithError reports err in the common format and terminates.
+func exitWithError(err error) {
+	var uerr *usageError
+	if errors.As(err, &uerr) {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", uerr.msg)
+		if uerr.cmd != nil {
+			fmt.Fprintf(os.Stderr, "Run 'norrvpn help %s' for usage.\n", uerr.cmd.name)
+		} else {
+			fmt.Fprintf(os.Stderr, "Run 'norrvpn help' for usage.\n")
+		}
+		os.Exit(2)
+	}
+	fmt.Fprintf(os.Stderr, "Error: %s\n", redact(err.Error()))
+	os.Exit(1)
+}
+
+// serverSelection holds the location flags shared by commands that pick a
+// server, so that they all accept the same forms.
+type serverSelection struct {
+	country string
+	city    string
+	server  string
+	group   string
+}
+
+func (s *serverSelection) register(cmd *command) {
+	fs := cmd.flags
+	fs.StringVar(&s.country, "country", "", "Country code, e.g. de or gb")
+	fs.StringVar(&s.city, "city", "", "City name within the country")
+	fs.StringVar(&s.server, "server", "", "Server hostname, e.g. de1234 or de1234.nordvpn.com")
+	fs.StringVar(&s.group, "group", "", "Server group, e.g. p2p or double_vpn")
+
+	cmd.completeArgs = completeLocation
+	cmd.completeFlags["country"] = completeCountries
+	cmd.completeFlags["city"] = completeCities
+	cmd.completeFlags["server"] = completeServers
+	cmd.completeFlags["group"] = completeGroups
+}
+
+// filter merges the positional [cc] [city...] forms with the flags and
+// resolves them against the API. City names may span several arguments.
+func (s *serverSelection) filter(cmd *command, args []string) (serverFilter, error) {
+	country, city := s.country, s.city
+	if len(args) > 0 {
+		if country != "" {
+			return serverFilter{}, cmd.usagef("country given both as argument and --country")
+		}
+		country = args[0]
+	}
+	if len(args) > 1 {
+		if city != "" {
+			return serverFilter{}, cmd.usagef("city given both as argument and --city")
+		}
+		city = strings.Join(args[1:], " ")
+	}
+
+	var filter serverFilter
+	if s.server != "" {
+		if country != "" || city != "" || s.group != "" {
+			return filter, cmd.usagef("--server cannot be combined with a country, city or group")
+		}
+		filter.Hostname = strings.ToLower(s.server)
+		if !strings.Contains(filter.Hostname, ".") {
+			filter.Hostname += ".nordvpn.com"
+		}
+		return filter, nil
+	}
+	if city != "" && country == "" {
+		return filter, cmd.usagef("a city requires a country")
+	}
+
+	if country != "" {
+		filter.CountryID = getCountryCode(country)
+		if filter.CountryID == -1 {
+			return filter, fmt.Errorf("invalid country code '%s'", country)
+		}
+	}
+	if city != "" {
+		filter.CityID = getCityCode(filter.CountryID, city)
+		if filter.CityID == -1 {
+			return filter, fmt.Errorf("invalid city name '%s' for country '%s'", city, country)
+		}
+	}
+	if s.group != "" {
+		filter.Group = getGroupIdentifier(s.group)
+		if filter.Group == "" {
+			return filter, fmt.Errorf("unknown server group '%s'", s.group)
+		}
+	}
+	return filter, nil
+}
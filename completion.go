@@ -0,0 +1,309 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// completionContext describes the command line up to the word being
+// completed.
+type completionContext struct {
+	args  []string          // positional arguments before the current word
+	flags map[string]string // flag values given so far
+	word  string            // the word being completed
+}
+
+// completer returns candidates for ctx.word; callers filter by prefix.
+type completer func(ctx *completionContext) []string
+
+const bashCompletion = `# bash completion for norrvpn
+_norrvpn() {
+	local IFS=$'\n' candidate
+	COMPREPLY=()
+	while read -r candidate; do
+		COMPREPLY+=("$(printf '%q' "$candidate")")
+	done < <(norrvpn __complete "${COMP_WORDS[@]:1:COMP_CWORD}" 2>/dev/null)
+}
+complete -F _norrvpn norrvpn`
+
+const zshCompletion = `#compdef norrvpn
+_norrvpn() {
+	local out
+	out=$(norrvpn __complete "${(@)words[2,CURRENT]}" 2>/dev/null)
+	[[ -n $out ]] && compadd -U -- "${(@f)out}"
+}
+compdef _norrvpn norrvpn`
+
+const fishCompletion = `# fish completion for norrvpn
+function __norrvpn_complete
+	set -l words (commandline -opc) (commandline -ct)
+	norrvpn __complete $words[2..-1] 2>/dev/null
+end
+complete -c norrvpn -f -a '(__norrvpn_complete)'`
+
+var completionScripts = map[string]string{
+	"bash": bashCompletion,
+	"zsh":  zshCompletion,
+	"fish": fishCompletion,
+}
+
+func newCompletionCommand() *command {
+	cmd := newCommand("completion", "bash|zsh|fish", "Print a shell completion script")
+	cmd.minArgs, cmd.maxArgs = 1, 1
+	cmd.completeArgs = func(ctx *completionContext) []string {
+		if len(ctx.args) > 0 {
+			return nil
+		}
+		return []string{"bash", "zsh", "fish"}
+	}
+	cmd.run = func(args []string) error {
+		script, ok := completionScripts[args[0]]
+		if !ok {
+			return cmd.usagef("unsupported shell %q", args[0])
+		}
+		fmt.Println(script)
+		return nil
+	}
+	return cmd
+}
+
+// newCompleteCommand is the hidden backend of the completion scripts. It
+// receives the words after "norrvpn" up to and including the one under the
+// cursor and prints one candidate per line.
+func newCompleteCommand() *command {
+	cmd := newCommand("__complete", "[words]", "Print completion candidates")
+	cmd.hidden = true
+	cmd.rawArgs = true
+	cmd.run = func(args []string) error {
+		apiClient.Timeout = 3 * time.Second
+		for _, candidate := range complete(args) {
+			fmt.Println(candidate)
+		}
+		return nil
+	}
+	return cmd
+}
+
+func complete(words []string) (candidates []string) {
+	// Lookups hit the catalog or the API; a failure just means no candidates.
+	defer func() {
+		if recover() != nil {
+			candidates = nil
+		}
+	}()
+
+	words, split := joinAssignments(words)
+	if len(words) == 0 {
+		words = []string{""}
+	}
+	word := words[len(words)-1]
+	before := words[:len(words)-1]
+
+	i := 0
+	for i < len(before) && strings.HasPrefix(before[i], "-") {
+		if takesValue(flag.CommandLine, before[i]) {
+			i++
+		}
+		i++
+	}
+	if i > len(before) {
+		return nil
+	}
+	if i == len(before) {
+		if strings.HasPrefix(word, "-") {
+			return matchPrefix(flagNames(flag.CommandLine), word)
+		}
+		var names []string
+		for _, c := range commands {
+			if !c.hidden {
+				names = append(names, c.name)
+			}
+		}
+		return matchPrefix(names, word)
+	}
+
+	cmd := findCommand(before[i])
+	if cmd == nil || cmd.rawArgs {
+		return nil
+	}
+	ctx := &completionContext{flags: map[string]string{}, word: word}
+	pending := ""
+	rest := before[i+1:]
+	for j, w := range rest {
+		if pending != "" {
+			ctx.flags[pending] = w
+			pending = ""
+			continue
+		}
+		if w == "--" {
+			ctx.args = append(ctx.args, rest[j+1:]...)
+			return completeWith(cmd.completeArgs, ctx)
+		}
+		if strings.HasPrefix(w, "-") && len(w) > 1 {
+			name, value, hasValue := strings.Cut(strings.TrimLeft(w, "-"), "=")
+			if hasValue {
+				ctx.flags[name] = value
+			} else if takesValue(cmd.flags, w) {
+				pending = name
+			}
+			continue
+		}
+		ctx.args = append(ctx.args, w)
+	}
+
+	if pending != "" {
+		return completeWith(cmd.completeFlags[pending], ctx)
+	}
+	if strings.HasPrefix(word, "-") {
+		if name, value, ok := strings.Cut(strings.TrimLeft(word, "-"), "="); ok {
+			ctx.word = value
+			values := completeWith(cmd.completeFlags[name], ctx)
+			if !split {
+				for k := range values {
+					values[k] = "--" + name + "=" + values[k]
+				}
+			}
+			return values
+		}
+		return matchPrefix(flagNames(cmd.flags), word)
+	}
+	return completeWith(cmd.completeArgs, ctx)
+}
+
+// joinAssignments undoes bash splitting "--flag=value" into three words. It
+// reports whether it did so, as bash then only replaces the part after "=".
+func joinAssignments(words []string) ([]string, bool) {
+	var joined []string
+	split := false
+	for i := 0; i < len(words); i++ {
+		if words[i] == "=" && len(joined) > 0 && strings.HasPrefix(joined[len(joined)-1], "-") {
+			joined[len(joined)-1] += "="
+			if i+1 < len(words) {
+				joined[len(joined)-1] += words[i+1]
+				i++
+			}
+			split = i == len(words)-1
+			continue
+		}
+		joined = append(joined, words[i])
+	}
+	return joined, split
+}
+
+func takesValue(fs *flag.FlagSet, word string) bool {
+	name := strings.TrimLeft(word, "-")
+	if strings.Contains(name, "=") {
+		return false
+	}
+	f := fs.Lookup(name)
+	if f == nil {
+		return false
+	}
+	if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+		return false
+	}
+	return true
+}
+
+func flagNames(fs *flag.FlagSet) []string {
+	var names []string
+	fs.VisitAll(func(f *flag.Flag) { names = append(names, "--"+f.Name) })
+	return names
+}
+
+func completeWith(c completer, ctx *completionContext) []string {
+	if c == nil {
+		return nil
+	}
+	return matchPrefix(c(ctx), ctx.word)
+}
+
+func matchPrefix(candidates []string, prefix string) []string {
+	var matched []string
+	for _, candidate := range candidates {
+		if strings.HasPrefix(strings.ToLower(candidate), strings.ToLower(prefix)) {
+			matched = append(matched, candidate)
+		}
+	}
+	return matched
+}
+
+func completeCountries(*completionContext) []string {
+	var codes []string
+	for _, country := range getCountryList() {
+		codes = append(codes, strings.ToLower(country.Code))
+	}
+	return codes
+}
+
+func completeCities(ctx *completionContext) []string {
+	code := ctx.flags["country"]
+	if code == "" && len(ctx.args) > 0 {
+		code = ctx.args[0]
+	}
+	var names []string
+	for _, country := range getCountryList() {
+		if strings.EqualFold(country.Code, code) {
+			for _, city := range country.Cities {
+				names = append(names, city.Name)
+			}
+		}
+	}
+	return names
+}
+
+// completeLocation completes the positional [cc] [city...] form. A city name
+// typed as several words is matched as a whole and only its remaining words
+// are offered.
+func completeLocation(ctx *completionContext) []string {
+	if len(ctx.args) == 0 {
+		return completeCountries(ctx)
+	}
+	typed := ""
+	if len(ctx.args) > 1 {
+		typed = strings.Join(ctx.args[1:], " ") + " "
+	}
+	var rest []string
+	for _, city := range completeCities(&completionContext{args: ctx.args[:1], flags: ctx.flags}) {
+		if len(city) > len(typed) && strings.EqualFold(city[:len(typed)], typed) {
+			rest = append(rest, city[len(typed):])
+		}
+	}
+	return rest
+}
+
+// completeServers offers hostnames from the catalog, fetching a batch of
+// recommendations first when nothing is known for the chosen country.
+func completeServers(ctx *completionContext) []string {
+	code := ctx.flags["country"]
+	if code == "" && len(ctx.args) > 0 {
+		code = ctx.args[0]
+	}
+	matching := func() []string {
+		var hosts []string
+		for _, server := range cachedServers() {
+			if code == "" || strings.EqualFold(server.Country, code) {
+				hosts = append(hosts, server.Hostname)
+			}
+		}
+		return hosts
+	}
+	hosts := matching()
+	if len(hosts) == 0 && code != "" {
+		if id := getCountryCode(code); id > 0 {
+			fetchServerList(serverFilter{CountryID: id}, 50)
+			hosts = matching()
+		}
+	}
+	return hosts
+}
+
+func completeGroups(*completionContext) []string {
+	var identifiers []string
+	for _, group := range getGroupList() {
+		identifiers = append(identifiers, group.Identifier)
+	}
+	return identifiers
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+var configPath = tokenPath + "/config.json"
+
+// config holds optional settings from config.json; command line flags take
+// precedence over it.
+type config struct {
+	// Rotate is the default for up --rotate, e.g. "30m".
+	Rotate string `json:"rotate,omitempty"`
+	// MaxLoad is the default for up --max-load, in percent.
+	MaxLoad int `json:"max_load,omitempty"`
+	// Hooks maps a phase (pre-up, post-up, pre-down, post-down) to shell
+	// commands run after the executables in hooks.d.
+	Hooks map[string][]string `json:"hooks,omitempty"`
+	// Webhooks receive signed state change events.
+	Webhooks []webhookConfig `json:"webhooks,omitempty"`
+	// Notifications enables desktop notifications.
+	Notifications bool `json:"notifications,omitempty"`
+	// Metrics is the default for --metrics of daemon and up.
+	Metrics string `json:"metrics,omitempty"`
+	// CheckIPURL is the default for check --ip-url.
+	CheckIPURL string `json:"check_ip_url,omitempty"`
+}
+
+// loadConfig reads config.json. A missing file is an empty config.
+func loadConfig() (config, error) {
+	var cfg config
+	data, err := os.ReadFile(configPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("%s: %w", configPath, err)
+	}
+	return cfg, nil
+}
+
+func configDuration(name, value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s: invalid %s %q", configPath, name, value)
+	}
+	return d, nil
+}
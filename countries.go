@@ -1,20 +1,10 @@
 package main
 
-import (
-	"encoding/json"
-	"io"
-	"net/http"
-	"strings"
-)
+import "strings"
 
 func getCountryList() countries {
-	resp, err := http.Get("https://api.nordvpn.com/v1/servers/countries")
-	panicer(err)
-	defer resp.Body.Close()
-	data, err := io.ReadAll(resp.Body)
-	panicer(err)
 	c := countries{}
-	panicer(json.Unmarshal(data, &c))
+	panicer(fetchCached("https://api.nordvpn.com/v1/servers/countries", "countries.json", &c))
 	return c
 }
 
@@ -47,3 +37,22 @@ type countries []struct {
 	ServerCount int    `json:"serverCount"`
 	Cities      []City `json:"cities"`
 }
+
+func getGroupList() []Groups {
+	var groups []Groups
+	panicer(fetchCached("https://api.nordvpn.com/v1/servers/groups", "groups.json", &groups))
+	return groups
+}
+
+// getGroupIdentifier resolves a group given by identifier ("legacy_p2p"),
+// short name ("p2p") or title ("P2P") to its API identifier.
+func getGroupIdentifier(name string) string {
+	for _, group := range getGroupList() {
+		if strings.EqualFold(group.Identifier, name) ||
+			strings.EqualFold(group.Identifier, "legacy_"+name) ||
+			strings.EqualFold(group.Title, name) {
+			return group.Identifier
+		}
+	}
+	return ""
+}
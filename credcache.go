@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// credentialsMaxAge is how long cached credentials are used before the API
+// is asked again. A key changed in between (UpdatedAt) is noticed earlier
+// when a handshake fails, see renewPrivateKey.
+const credentialsMaxAge = 24 * time.Hour
+
+var credentialsCachePath = tokenPath + "/credentials.enc"
+var credentialsKeyPath = tokenPath + "/credentials.key"
+
+type cachedCredentials struct {
+	Creds     Creds     `json:"creds"`
+	FetchedAt time.Time `json:"fetched_at"`
+}
+
+// ownPrivateKey returns the NordLynx private key, from the encrypted cache
+// while it is fresh and from the credentials endpoint otherwise. When the
+// API or the token cannot be reached a stale cache is used instead.
+func ownPrivateKey() (string, error) {
+	cached, cacheErr := loadCredentials()
+	if cacheErr == nil {
+		registerSecret(cached.Creds.NordlynxPrivateKey)
+		if time.Since(cached.FetchedAt) < credentialsMaxAge {
+			return cached.Creds.NordlynxPrivateKey, nil
+		}
+	}
+
+	creds, err := refreshCredentials()
+	if err == nil {
+		return creds.NordlynxPrivateKey, nil
+	}
+	if cacheErr != nil || errors.Is(err, errTokenRejected) || errors.Is(err, errNoVPNService) {
+		return "", err
+	}
+	slog.Warn("using cached credentials", "age", time.Since(cached.FetchedAt).Round(time.Minute), "err", err)
+	return cached.Creds.NordlynxPrivateKey, nil
+}
+
+// renewPrivateKey asks the API again, bypassing the cache, after a tunnel
+// with the cached key did not come up. It returns the new key when
+// UpdatedAt shows that the key was changed since it was cached.
+func renewPrivateKey() (string, bool) {
+	cached, err := loadCredentials()
+	if err != nil {
+		return "", false
+	}
+	creds, err := refreshCredentials()
+	if err != nil || creds.UpdatedAt == cached.Creds.UpdatedAt {
+		return "", false
+	}
+	return creds.NordlynxPrivateKey, true
+}
+
+// refreshCredentials fetches the credentials with the stored token and
+// updates the cache.
+func refreshCredentials() (Creds, error) {
+	token, store, err := lookupToken()
+	if err != nil {
+		return Creds{}, err
+	}
+	return refreshCredentialsWith(token, store)
+}
+
+// refreshCredentialsWith fetches the credentials with token and caches them
+// under a key kept in store, the one that holds the token.
+func refreshCredentialsWith(token string, store secretStore) (Creds, error) {
+	creds, err := fetchCredentials(token)
+	if err != nil {
+		return Creds{}, err
+	}
+	if cached, err := loadCredentials(); err == nil && cached.Creds.UpdatedAt != creds.UpdatedAt {
+		slog.Info("NordLynx credentials changed, cache updated", "updated_at", creds.UpdatedAt)
+	}
+	if err := saveCredentials(cachedCredentials{Creds: creds, FetchedAt: time.Now()}, store); err != nil {
+		slog.Warn("could not cache credentials", "err", err)
+	} else {
+		slog.Debug("credentials cached", "path", credentialsCachePath)
+	}
+	return creds, nil
+}
+
+func loadCredentials() (cachedCredentials, error) {
+	var cached cachedCredentials
+	sealed, err := os.ReadFile(credentialsCachePath)
+	if err != nil {
+		return cached, err
+	}
+	key, _, err := lookupSecret(credentialsKeySecret, errSecretNotFound)
+	if err != nil {
+		return cached, fmt.Errorf("credentials cache key: %w", err)
+	}
+	gcm, err := credentialsCipher(key)
+	if err != nil {
+		return cached, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return cached, errors.New("credentials cache is truncated")
+	}
+	data, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return cached, fmt.Errorf("decrypting credentials cache: %w", err)
+	}
+	err = json.Unmarshal(data, &cached)
+	return cached, err
+}
+
+// saveCredentials encrypts the cache with a new key, which goes into store.
+func saveCredentials(cached cachedCredentials, store secretStore) error {
+	data, err := json.Marshal(cached)
+	if err != nil {
+		return err
+	}
+	secret := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, secret); err != nil {
+		return err
+	}
+	key := hex.EncodeToString(secret)
+	registerSecret(key)
+	gcm, err := credentialsCipher(key)
+	if err != nil {
+		return err
+	}
+	if err := setSecret(store, credentialsKeySecret, key); err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(tokenPath, 0700); err != nil {
+		return err
+	}
+	return writePrivateFile(credentialsCachePath, gcm.Seal(nonce, nonce, data, nil))
+}
+
+func removeCredentials() error {
+	var errs []error
+	if err := removeSecretFile(credentialsCachePath); err != nil && !os.IsNotExist(err) {
+		errs = append(errs, err)
+	}
+	for _, store := range secretStores {
+		if err := store.remove(credentialsKeySecret); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", store.name(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// credentialsCipher returns the cipher for a hex encoded cache key. The key
+// is kept in the secret store of the token, not next to the cache, unless
+// that is the file store; the token itself is not used, as the cache has to
+// work while the token is locked away.
+func credentialsCipher(key string) (cipher.AEAD, error) {
+	secret, err := hex.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("credentials cache key: %w", err)
+	}
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,501 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const daemonGroup = "norrvpn"
+
+var daemonSocket = flag.String("socket", "/run/norrvpn/norrvpnd.sock", "Control socket of the norrvpn daemon")
+
+// daemonConnectRequest is the body of POST /connect and POST /switch.
+type daemonConnectRequest struct {
+	Filter  serverFilter `json:"filter"`
+	Rotate  string       `json:"rotate,omitempty"`
+	MaxLoad int          `json:"max_load,omitempty"`
+}
+
+// daemonRepairRequest is the body of POST /repair.
+type daemonRepairRequest struct {
+	DryRun     bool `json:"dry_run,omitempty"`
+	Disconnect bool `json:"disconnect,omitempty"`
+}
+
+type daemonRepairResponse struct {
+	Actions []string `json:"actions"`
+	Output  string   `json:"output,omitempty"`
+}
+
+type daemonStatus struct {
+	Connected bool       `json:"connected"`
+	Interface string     `json:"interface,omitempty"`
+	Server    *Server    `json:"server,omitempty"`
+	Handshake *time.Time `json:"handshake,omitempty"`
+	RxBytes   uint64     `json:"rx_bytes,omitempty"`
+	TxBytes   uint64     `json:"tx_bytes,omitempty"`
+	// Output is what connect, switch or disconnect and their hooks printed.
+	Output string `json:"output,omitempty"`
+}
+
+type daemonError struct {
+	Error  string `json:"error"`
+	Output string `json:"output,omitempty"`
+}
+
+func newDaemonCommand() *command {
+	cmd := newCommand("daemon", "", "Run the control daemon (also started as norrvpnd)")
+	cmd.maxArgs = 0
+	metricsFlag := registerMetricsFlag(cmd)
+	cmd.run = func([]string) error {
+		return runDaemon(metricsAddress(cmd, *metricsFlag))
+	}
+	return cmd
+}
+
+// daemon owns the tunnel and serves the control API over a Unix socket, so
+// that members of the norrvpn group can control the VPN without sudo.
+type daemon struct {
+	mu        sync.Mutex
+	stopWatch context.CancelFunc
+}
+
+func runDaemon(metricsAddr string) error {
+	if err := os.MkdirAll(filepath.Dir(*daemonSocket), 0755); err != nil {
+		return err
+	}
+	// Not dialDaemon, which pretends there is none under --dry-run.
+	if conn, err := net.Dial("unix", *daemonSocket); err == nil {
+		conn.Close()
+		return fmt.Errorf("daemon already running on %s", *daemonSocket)
+	}
+	os.Remove(*daemonSocket)
+	listener, err := net.Listen("unix", *daemonSocket)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(*daemonSocket)
+	if err := restrictSocket(*daemonSocket); err != nil {
+		return err
+	}
+
+	d := &daemon{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", d.handleStatus)
+	mux.HandleFunc("POST /connect", d.handleConnect)
+	mux.HandleFunc("POST /disconnect", d.handleDisconnect)
+	mux.HandleFunc("POST /switch", d.handleSwitch)
+	mux.HandleFunc("POST /repair", d.handleRepair)
+	mux.HandleFunc("GET /servers", d.handleServers)
+	mux.HandleFunc("GET /events", d.handleEvents)
+	server := &http.Server{Handler: mux}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		d.setWatch(nil)
+		// Event streams never finish on their own, so do not wait for them.
+		shutdown, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		server.Shutdown(shutdown)
+		server.Close()
+	}()
+
+	if err := startMetrics(ctx, metricsAddr); err != nil {
+		return fmt.Errorf("metrics: %w", err)
+	}
+	go monitorLoop(ctx, true)
+	go webhookLoop(ctx)
+	slog.Info("daemon listening", "socket", *daemonSocket)
+	if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	slog.Info("daemon stopped, the connection is left as it is")
+	return nil
+}
+
+// restrictSocket gives the norrvpn group access to the socket, or nobody
+// but root when the group does not exist.
+func restrictSocket(path string) error {
+	group, err := user.LookupGroup(daemonGroup)
+	if err != nil {
+		slog.Warn("group not found, only root can use the daemon", "group", daemonGroup)
+		return os.Chmod(path, 0600)
+	}
+	gid, err := strconv.Atoi(group.Gid)
+	if err != nil {
+		return err
+	}
+	if err := os.Chown(path, 0, gid); err != nil {
+		return err
+	}
+	return os.Chmod(path, 0660)
+}
+
+// setWatch replaces the running watch loop, if any.
+func (d *daemon) setWatch(start func(ctx context.Context)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.stopWatch != nil {
+		d.stopWatch()
+		d.stopWatch = nil
+	}
+	if start != nil {
+		var ctx context.Context
+		ctx, d.stopWatch = context.WithCancel(context.Background())
+		go start(ctx)
+	}
+}
+
+func currentStatus() daemonStatus {
+	snap := readSnapshot()
+	status := daemonStatus{Interface: snap.iface, Connected: snap.iface != ""}
+	if status.Connected {
+		if snap.server.Hostname != "" {
+			status.Server = &snap.server
+		}
+		var e event
+		snap.fill(&e)
+		status.Handshake, status.RxBytes, status.TxBytes = e.Handshake, e.RxBytes, e.TxBytes
+	}
+	return status
+}
+
+// event describes the status as a connected or disconnected event.
+func (s daemonStatus) event() event {
+	if !s.Connected {
+		return event{Type: "disconnected", Time: time.Now()}
+	}
+	var server Server
+	if s.Server != nil {
+		server = *s.Server
+	}
+	e := serverEvent("connected", s.Interface, server)
+	e.Time = time.Now()
+	e.Handshake, e.RxBytes, e.TxBytes = s.Handshake, s.RxBytes, s.TxBytes
+	return e
+}
+
+func (d *daemon) handleStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, currentStatus())
+}
+
+func (d *daemon) handleConnect(w http.ResponseWriter, r *http.Request) {
+	var req daemonConnectRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, daemonError{Error: err.Error()})
+		return
+	}
+	opts := watchOptions{maxLoad: req.MaxLoad}
+	if req.Rotate != "" {
+		var err error
+		if opts.rotate, err = time.ParseDuration(req.Rotate); err != nil {
+			writeJSON(w, http.StatusBadRequest, daemonError{Error: err.Error()})
+			return
+		}
+	}
+	out, err := lockedWithOutput(func() error {
+		if active := activeInterface(); active != "" {
+			return fmt.Errorf("interface %s already exists. Please disconnect first or use 'norrvpn switch'", active)
+		}
+		return connect(req.Filter)
+	})
+	if err != nil {
+		emitEvent(failureEvent("connect", err))
+		writeJSON(w, http.StatusConflict, daemonError{Error: redact(err.Error()), Output: out})
+		return
+	}
+	if opts.enabled() {
+		d.setWatch(func(ctx context.Context) { watchLoop(ctx, req.Filter, opts) })
+	} else {
+		d.setWatch(nil)
+	}
+	status := currentStatus()
+	status.Output = out
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (d *daemon) handleDisconnect(w http.ResponseWriter, r *http.Request) {
+	d.setWatch(nil)
+	out, err := lockedWithOutput(disconnect)
+	if err != nil {
+		emitEvent(failureEvent("disconnect", err))
+		writeJSON(w, http.StatusConflict, daemonError{Error: redact(err.Error()), Output: out})
+		return
+	}
+	status := currentStatus()
+	status.Output = out
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (d *daemon) handleSwitch(w http.ResponseWriter, r *http.Request) {
+	var req daemonConnectRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, daemonError{Error: err.Error()})
+		return
+	}
+	out, err := lockedWithOutput(func() error { return switchServer(req.Filter, nil, "switch") })
+	if err != nil {
+		emitEvent(failureEvent("switch", err))
+		writeJSON(w, http.StatusConflict, daemonError{Error: redact(err.Error()), Output: out})
+		return
+	}
+	status := currentStatus()
+	status.Output = out
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (d *daemon) handleRepair(w http.ResponseWriter, r *http.Request) {
+	var req daemonRepairRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, daemonError{Error: err.Error()})
+		return
+	}
+	if req.Disconnect && !req.DryRun {
+		d.setWatch(nil)
+	}
+	var actions []string
+	out, err := lockedWithOutput(func() error {
+		var err error
+		actions, err = repair(req.DryRun, req.Disconnect)
+		return err
+	})
+	if err != nil {
+		emitEvent(failureEvent("repair", err))
+		writeJSON(w, http.StatusConflict, daemonError{Error: redact(err.Error()), Output: out})
+		return
+	}
+	writeJSON(w, http.StatusOK, daemonRepairResponse{Actions: actions, Output: out})
+}
+
+// lockedWithOutput runs f like locked and returns what it printed to output
+// and errOutput, for the client. The daemon's own stdout and stderr still
+// get it, so that it also ends up in the journal.
+func lockedWithOutput(f func() error) (string, error) {
+	var buf syncBuffer
+	err := locked(func() error {
+		output, errOutput = io.MultiWriter(os.Stdout, &buf), io.MultiWriter(os.Stderr, &buf)
+		defer func() { output, errOutput = os.Stdout, os.Stderr }()
+		return f()
+	})
+	return redact(buf.String()), err
+}
+
+// syncBuffer is a bytes.Buffer that hooks can write their stdout and stderr
+// to at the same time.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// handleServers lists recommended servers; the query takes the serverFilter
+// fields and a limit.
+func (d *daemon) handleServers(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := serverFilter{Group: query.Get("group"), Hostname: query.Get("hostname")}
+	filter.CountryID, _ = strconv.Atoi(query.Get("country_id"))
+	filter.CityID, _ = strconv.Atoi(query.Get("city_id"))
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = 20
+	}
+	servers, err := fetchServerList(filter, limit)
+	if err != nil {
+		writeJSON(w, http.StatusBadGateway, daemonError{Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, servers)
+}
+
+// handleEvents streams events as newline-delimited JSON until the client
+// goes away.
+func (d *daemon) handleEvents(w http.ResponseWriter, r *http.Request) {
+	events, cancel := subscribe()
+	defer cancel()
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	encoder := json.NewEncoder(w)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e := <-events:
+			if encoder.Encode(e) != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// daemonClient talks to a running daemon; commands use it instead of
+// changing the network themselves when one is available.
+type daemonClient struct {
+	http *http.Client
+}
+
+// dialDaemon returns a client when a daemon is listening on the socket and
+// this is not a dry run.
+func dialDaemon() *daemonClient {
+	// The daemon would make the changes, a dry run has to plan them here.
+	if *dryRunFlag {
+		return nil
+	}
+	conn, err := net.DialTimeout("unix", *daemonSocket, time.Second)
+	if err != nil {
+		return nil
+	}
+	conn.Close()
+	dial := func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", *daemonSocket)
+	}
+	return &daemonClient{http: &http.Client{Transport: &http.Transport{DialContext: dial}}}
+}
+
+// call sends in as JSON and decodes the response into out; error responses
+// become errors.
+func (c *daemonClient) call(method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, "http://norrvpnd"+path, body)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("daemon: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var derr daemonError
+		if json.NewDecoder(resp.Body).Decode(&derr) != nil || derr.Error == "" {
+			derr.Error = resp.Status
+		}
+		fmt.Print(derr.Output)
+		return errors.New(derr.Error)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (c *daemonClient) status() (daemonStatus, error) {
+	var status daemonStatus
+	err := c.call("GET", "/status", nil, &status)
+	return status, err
+}
+
+func (c *daemonClient) connect(filter serverFilter, opts watchOptions) error {
+	req := daemonConnectRequest{Filter: filter, MaxLoad: opts.maxLoad}
+	if opts.rotate > 0 {
+		req.Rotate = opts.rotate.String()
+	}
+	var status daemonStatus
+	if err := c.call("POST", "/connect", req, &status); err != nil {
+		return err
+	}
+	fmt.Print(status.Output)
+	if opts.enabled() {
+		fmt.Printf("The daemon keeps watching the connection: %s\n", opts)
+	}
+	return nil
+}
+
+func (c *daemonClient) disconnect() error {
+	var status daemonStatus
+	if err := c.call("POST", "/disconnect", nil, &status); err != nil {
+		return err
+	}
+	fmt.Print(status.Output)
+	fmt.Printf("Disconnected\n")
+	return nil
+}
+
+func (c *daemonClient) switchServer(filter serverFilter) error {
+	var status daemonStatus
+	if err := c.call("POST", "/switch", daemonConnectRequest{Filter: filter}, &status); err != nil {
+		return err
+	}
+	fmt.Print(status.Output)
+	return nil
+}
+
+func (c *daemonClient) repair(dryRun, disconnect bool) ([]string, error) {
+	var resp daemonRepairResponse
+	err := c.call("POST", "/repair", daemonRepairRequest{DryRun: dryRun, Disconnect: disconnect}, &resp)
+	fmt.Print(resp.Output)
+	return resp.Actions, err
+}
+
+// events calls f for every event until the stream ends or f fails.
+func (c *daemonClient) events(f func(event) error) error {
+	resp, err := c.http.Get("http://norrvpnd/events")
+	if err != nil {
+		return fmt.Errorf("daemon: %w", err)
+	}
+	defer resp.Body.Close()
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		var e event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return err
+		}
+		if err := f(e); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return errors.New("daemon closed the event stream")
+}
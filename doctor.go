@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// capNetAdmin is the capability bit needed to change links, routes and
+	// rules.
+	capNetAdmin = 12
+	// maxClockSkew is how far the clock may be off before doctor warns; TLS
+	// to the API fails once it is off by much more.
+	maxClockSkew  = time.Minute
+	doctorTimeout = 10 * time.Second
+)
+
+func newDoctorCommand() *command {
+	cmd := newCommand("doctor", "", "Check prerequisites and look for conflicting network setup")
+	cmd.maxArgs = 0
+	cmd.run = func([]string) error {
+		results := []checkResult{doctorPrivileges()}
+		results = append(results, doctorTools()...)
+		results = append(results, doctorModule())
+		results = append(results, doctorInterfaces())
+		results = append(results, doctorRouting()...)
+		results = append(results, doctorOtherVPNs()...)
+		results = append(results, doctorFiles()...)
+		results = append(results, doctorAPI()...)
+		if failed := printChecks(results); failed > 0 {
+			return fmt.Errorf("%d of %d checks failed", failed, len(results))
+		}
+		return nil
+	}
+	return cmd
+}
+
+func doctorPrivileges() checkResult {
+	result := checkResult{name: "privileges"}
+	if os.Geteuid() == 0 {
+		result.status, result.detail = checkPass, "running as root"
+		return result
+	}
+	if hasCapability(capNetAdmin) {
+		result.status, result.detail = checkPass, "CAP_NET_ADMIN is effective"
+		return result
+	}
+	result.status, result.detail = checkFail, "not root and without CAP_NET_ADMIN, connecting will fail"
+	result.fix = "run norrvpn with sudo"
+	return result
+}
+
+// hasCapability reports whether capability bit is in the effective set of
+// this process.
+func hasCapability(bit uint) bool {
+	file, err := os.Open("/proc/self/status")
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		value, ok := strings.CutPrefix(scanner.Text(), "CapEff:")
+		if !ok {
+			continue
+		}
+		caps, err := strconv.ParseUint(trim(value), 16, 64)
+		return err == nil && caps&(1<<bit) != 0
+	}
+	return false
+}
+
+func doctorTools() []checkResult {
+	tools := []struct{ name, pkg string }{{"ip", "iproute2"}, {"wg", "wireguard-tools"}}
+	var results []checkResult
+	for _, tool := range tools {
+		result := checkResult{name: tool.name}
+		if path, err := exec.LookPath(tool.name); err != nil {
+			result.status, result.detail = checkFail, tool.name+" not found in PATH"
+			result.fix = "install " + tool.pkg
+		} else {
+			result.status, result.detail = checkPass, path
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+func doctorModule() checkResult {
+	result := checkResult{name: "wireguard module"}
+	if _, err := os.Stat("/sys/module/wireguard"); err == nil {
+		result.status, result.detail = checkPass, "loaded"
+		return result
+	}
+	out, err := exec.Command("modinfo", "-F", "filename", "wireguard").Output()
+	switch {
+	case err == nil:
+		result.status, result.detail = checkPass, "available: "+trim(string(out))
+	case errors.Is(err, exec.ErrNotFound):
+		result.status, result.detail = checkWarn, "not loaded, and modinfo is not available to look for it"
+		result.fix = "modprobe wireguard"
+	default:
+		result.status, result.detail = checkFail, "not loaded and not available for this kernel"
+		result.fix = "use a kernel with WireGuard (5.6 or later) or install wireguard-dkms"
+	}
+	return result
+}
+
+// doctorInterfaces looks for tunnel interfaces that are left over from a
+// crash or an interrupted switch.
+func doctorInterfaces() checkResult {
+	var present []string
+	for _, name := range tunnelInterfaces {
+		if isWGInterfaceExists(name) {
+			present = append(present, name)
+		}
+	}
+	result := checkResult{name: "interfaces"}
+	_, serverErr := loadServerInfo()
+	switch {
+	case len(present) == 0:
+		result.status, result.detail = checkPass, "not connected"
+	case len(present) > 1:
+		result.status = checkWarn
+		result.detail = strings.Join(present, " and ") + " both exist, a switch was interrupted"
+		result.fix = "sudo norrvpn repair"
+	case serverErr != nil:
+		result.status = checkWarn
+		result.detail = present[0] + " exists, but no server is recorded for it"
+		result.fix = "sudo norrvpn repair --disconnect"
+	default:
+		result.status, result.detail = checkPass, present[0]+" is up"
+	}
+	return result
+}
+
+// doctorRouting looks for other software using the routing tables and rule
+// priorities of norrvpn, and for rules of norrvpn without an interface.
+func doctorRouting() []checkResult {
+	var results []checkResult
+	out, err := exec.Command("ip", "rule", "show").Output()
+	if err != nil {
+		return []checkResult{{name: "rules", status: checkSkip, detail: "ip rule show: " + err.Error()}}
+	}
+	active := activeInterface()
+	var stale []string
+	for _, line := range strings.Split(trim(string(out)), "\n") {
+		priority, _, _ := strings.Cut(line, ":")
+		ours := endpointRuleRe.MatchString(line) || tunnelRuleRe.MatchString(line)
+		usesTable := strings.Contains(line, "lookup 212450") || strings.Contains(line, "lookup 212451")
+		switch {
+		case ours && active == "":
+			stale = append(stale, line)
+		case !ours && (priority == "219" || priority == "220"):
+			results = append(results, checkResult{name: "rules", status: checkFail,
+				detail: fmt.Sprintf("priority %s is used by other software: %s", priority, trim(line)),
+				fix:    "move that rule to another priority"})
+		case !ours && usesTable:
+			results = append(results, checkResult{name: "rules", status: checkFail,
+				detail: "a rule of other software uses a norrvpn table: " + trim(line),
+				fix:    "move that rule to another table"})
+		}
+	}
+	if len(stale) > 0 {
+		results = append(results, checkResult{name: "rules", status: checkWarn,
+			detail: fmt.Sprintf("%d norrvpn rules left without a tunnel interface", len(stale)),
+			fix:    "sudo norrvpn repair"})
+	}
+
+	for _, name := range tunnelInterfaces {
+		table := routingTable(name)
+		out, err := exec.Command("ip", "route", "show", "table", table).Output()
+		if err != nil {
+			continue
+		}
+		for _, route := range strings.Split(trim(string(out)), "\n") {
+			if route != "" && !strings.Contains(route, "dev "+name) {
+				results = append(results, checkResult{name: "routes", status: checkFail,
+					detail: fmt.Sprintf("table %s has a route of other software: %s", table, route),
+					fix:    fmt.Sprintf("sudo ip route flush table %s", table)})
+			}
+		}
+	}
+	if len(results) == 0 {
+		results = append(results, checkResult{name: "routing", status: checkPass,
+			detail: "tables 212450 and 212451 and priorities 219 and 220 are free"})
+	}
+	return results
+}
+
+// doctorOtherVPNs warns about other tunnels: rule 220 comes before the rules
+// of wg-quick and Tailscale, so their traffic ends up in the norrvpn tunnel.
+func doctorOtherVPNs() []checkResult {
+	var results []checkResult
+	out, err := exec.Command("ip", "-o", "link", "show", "type", "wireguard").Output()
+	if err == nil {
+		for _, line := range strings.Split(trim(string(out)), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 2 {
+				continue
+			}
+			name := strings.TrimSuffix(fields[1], ":")
+			if slices.Contains(tunnelInterfaces, name) {
+				continue
+			}
+			results = append(results, checkResult{name: "other vpn", status: checkWarn,
+				detail: name + " is another WireGuard interface (wg-quick?), its traffic would go into the norrvpn tunnel",
+				fix:    "wg-quick down " + name})
+		}
+	}
+	if isWGInterfaceExists("tailscale0") {
+		results = append(results, checkResult{name: "other vpn", status: checkWarn,
+			detail: "Tailscale is running, tailnet traffic would go into the norrvpn tunnel ahead of its table 52",
+			fix:    "tailscale down"})
+	}
+	if len(results) == 0 {
+		results = append(results, checkResult{name: "other vpn", status: checkPass, detail: "none found"})
+	}
+	return results
+}
+
+// doctorFiles checks that the files in tokenPath are private. Leaking the
+// token or the credentials key gives access to the account.
+func doctorFiles() []checkResult {
+	files := []struct {
+		path   string
+		secret bool
+	}{
+		{tokenPath, true},
+		{tokenFullPath, true},
+		{credentialsCachePath, true},
+		{credentialsKeyPath, true},
+		{configPath, false},
+		{serverInfoPath, false},
+		{serverFilterPath, false},
+		{historyPath, false},
+		{webhookQueuePath, false},
+	}
+	var results []checkResult
+	for _, file := range files {
+		info, err := os.Stat(file.path)
+		if err != nil {
+			continue
+		}
+		mode := info.Mode().Perm()
+		if mode&0077 == 0 {
+			continue
+		}
+		result := checkResult{name: "permissions", status: checkWarn,
+			detail: fmt.Sprintf("%s has mode %04o", file.path, mode)}
+		if file.secret {
+			result.status = checkFail
+		}
+		private := "600"
+		if info.IsDir() {
+			private = "700"
+		}
+		result.fix = fmt.Sprintf("chmod %s %s", private, file.path)
+		results = append(results, result)
+	}
+	if len(results) == 0 {
+		results = append(results, checkResult{name: "permissions", status: checkPass,
+			detail: tokenPath + " is private"})
+	}
+	return results
+}
+
+// doctorAPI checks that the API answers and compares its Date header with
+// the local clock.
+func doctorAPI() []checkResult {
+	api := checkResult{name: "api"}
+	client := &http.Client{Transport: apiClient.Transport, Timeout: doctorTimeout}
+	start := time.Now()
+	resp, err := client.Get(serverListURL(serverFilter{}, 1))
+	took := time.Since(start)
+	if err != nil {
+		api.status, api.detail = checkFail, err.Error()
+		api.fix = "check the network connection and DNS"
+		return []checkResult{api}
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		api.status, api.detail = checkFail, "api.nordvpn.com answered "+resp.Status
+		return []checkResult{api}
+	}
+	api.status, api.detail = checkPass, fmt.Sprintf("api.nordvpn.com answered in %s", took.Round(time.Millisecond))
+
+	clock := checkResult{name: "clock"}
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		clock.status, clock.detail = checkSkip, "no Date in the API response"
+		return []checkResult{api, clock}
+	}
+	skew := start.Add(took / 2).Sub(date).Round(time.Second)
+	if skew.Abs() > maxClockSkew {
+		clock.status = checkWarn
+		clock.detail = fmt.Sprintf("local clock is off by %s", skew)
+		clock.fix = "sudo timedatectl set-ntp true"
+	} else {
+		clock.status, clock.detail = checkPass, fmt.Sprintf("within %s of the API", maxClockSkew)
+	}
+	return []checkResult{api, clock}
+}
@@ -2,29 +2,170 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
 )
 
 const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
 
+// secretStore is a backend the NordVPN token and the credentials cache key
+// can be kept in, each under its own name.
+type secretStore interface {
+	name() string
+	// get returns errSecretNotFound when the store holds no such secret.
+	get(name string) (string, error)
+	set(name, secret string) error
+	// remove succeeds when there is nothing to remove.
+	remove(name string) error
+}
+
+// Names of the secrets in a secretStore.
+const (
+	tokenSecret          = "token"
+	credentialsKeySecret = "credentials-key"
+)
+
+var errSecretNotFound = errors.New("no token stored")
+
+// secretStores lists the backends in the order getToken probes them.
+var secretStores = []secretStore{fileStore{}, keyringStore{}, secretServiceStore{}}
+
+func findSecretStore(name string) secretStore {
+	for _, store := range secretStores {
+		if store.name() == name {
+			return store
+		}
+	}
+	return nil
+}
+
+func secretStoreNames() []string {
+	var names []string
+	for _, store := range secretStores {
+		names = append(names, store.name())
+	}
+	return names
+}
+
 func getToken() string {
-	data, err := os.ReadFile(tokenFullPath)
+	token, _, err := lookupToken()
 	panicer(err)
+	return token
+}
+
+// lookupToken returns the token from the first backend that holds one.
+func lookupToken() (string, secretStore, error) {
+	return lookupSecret(tokenSecret, errors.New("no token stored, run 'norrvpn init' first"))
+}
+
+// lookupSecret returns the named secret from the first backend that holds
+// it, or notFound joined with the errors of backends that failed.
+func lookupSecret(name string, notFound error) (string, secretStore, error) {
+	errs := []error{notFound}
+	for _, store := range secretStores {
+		secret, err := store.get(name)
+		if err == nil && secret != "" {
+			registerSecret(secret)
+			return secret, store, nil
+		}
+		if err != nil && !errors.Is(err, errSecretNotFound) {
+			errs = append(errs, fmt.Errorf("%s: %w", store.name(), err))
+		}
+	}
+	return "", nil, errors.Join(errs...)
+}
+
+// setToken saves the token in store and removes it from all other backends,
+// so that an old copy cannot shadow it.
+func setToken(store secretStore, token string) error {
+	return setSecret(store, tokenSecret, token)
+}
+
+func setSecret(store secretStore, name, secret string) error {
+	if err := store.set(name, secret); err != nil {
+		return fmt.Errorf("%s: %w", store.name(), err)
+	}
+	for _, other := range secretStores {
+		if other != store {
+			other.remove(name)
+		}
+	}
+	return nil
+}
+
+// fileStore keeps the token in tokenFullPath and the credentials cache key
+// in credentialsKeyPath, readable by the owner only. Both sit next to the
+// cache, so file permissions are all that protects it.
+type fileStore struct{}
+
+func (fileStore) name() string {
+	return "file"
+}
+
+func (fileStore) path(name string) string {
+	if name == credentialsKeySecret {
+		return credentialsKeyPath
+	}
+	return tokenFullPath
+}
+
+func (f fileStore) get(name string) (string, error) {
+	data, err := os.ReadFile(f.path(name))
+	if os.IsNotExist(err) {
+		return "", errSecretNotFound
+	}
+	if err != nil || name != tokenSecret {
+		return trim(string(data)), err
+	}
 	var token Token
-	err = json.Unmarshal(data, &token)
-	panicer(err)
-	return token.Token
+	if err := json.Unmarshal(data, &token); err != nil {
+		return "", err
+	}
+	return token.Token, nil
 }
 
-func setToken(token string) {
-	panicer(os.MkdirAll(tokenPath, 0700))
-	file, err := os.OpenFile(tokenFullPath, os.O_CREATE|os.O_WRONLY, 0600)
-	panicer(err)
-	tokenObject := Token{Token: token}
-	data, err := json.MarshalIndent(tokenObject, "", "  ")
-	panicer(err)
-	_, err = file.Write(data)
-	panicer(err)
+func (f fileStore) set(name, secret string) error {
+	if err := os.MkdirAll(tokenPath, 0700); err != nil {
+		return err
+	}
+	data := []byte(secret)
+	if name == tokenSecret {
+		var err error
+		if data, err = json.MarshalIndent(Token{Token: secret}, "", "  "); err != nil {
+			return err
+		}
+	}
+	return writePrivateFile(f.path(name), data)
+}
+
+func (f fileStore) remove(name string) error {
+	err := removeSecretFile(f.path(name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// removeSecretFile overwrites a file with zeros before unlinking it, so the
+// secret does not linger in the freed blocks of simple filesystems.
+func removeSecretFile(path string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err == nil {
+		_, err = file.Write(make([]byte, info.Size()))
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
 }
 
 type Token struct {
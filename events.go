@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"text/template"
+	"time"
+)
+
+// event is a change of the connection state, streamed to daemon clients.
+type event struct {
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	Interface string    `json:"interface,omitempty"`
+	Server    string    `json:"server,omitempty"`
+	Country   string    `json:"country,omitempty"`
+	City      string    `json:"city,omitempty"`
+	Message   string    `json:"message,omitempty"`
+	// Handshake and the traffic totals are filled in when known.
+	Handshake *time.Time `json:"handshake,omitempty"`
+	RxBytes   uint64     `json:"rx_bytes,omitempty"`
+	TxBytes   uint64     `json:"tx_bytes,omitempty"`
+}
+
+var (
+	subscribersMu sync.Mutex
+	subscribers   = map[chan event]struct{}{}
+)
+
+// serverEvent fills in the server fields of an event.
+func serverEvent(kind, interfaceName string, server Server) event {
+	e := event{Type: kind, Interface: interfaceName, Server: server.Hostname}
+	if len(server.Locations) > 0 {
+		e.Country = server.Locations[0].Country.Name
+		e.City = server.Locations[0].Country.City.Name
+	}
+	return e
+}
+
+// failureEvent reports a failed operation.
+func failureEvent(action string, err error) event {
+	return event{Type: "failed", Message: redact(fmt.Sprintf("%s: %v", action, err))}
+}
+
+// emitEvent sends e to all subscribers. Slow subscribers miss events rather
+// than blocking the tunnel operations.
+func emitEvent(e event) {
+	// A dry run changes nothing, so there is nothing to report.
+	if *dryRunFlag {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	slog.Debug("event", "type", e.Type, "server", e.Server, "interface", e.Interface)
+	metrics.countEvent(e.Type)
+	queueWebhooks(e)
+	notifyDesktop(e)
+	subscribersMu.Lock()
+	defer subscribersMu.Unlock()
+	for ch := range subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// subscribe returns a channel receiving all further events and a function
+// to stop receiving them.
+func subscribe() (<-chan event, func()) {
+	ch := make(chan event, 64)
+	subscribersMu.Lock()
+	subscribers[ch] = struct{}{}
+	subscribersMu.Unlock()
+	return ch, func() {
+		subscribersMu.Lock()
+		delete(subscribers, ch)
+		subscribersMu.Unlock()
+	}
+}
+
+// followEvents prints initial and then every further event until
+// interrupted, from the daemon when one runs and by polling otherwise.
+func followEvents(client *daemonClient, initial event, tmpl *template.Template) error {
+	if err := printEvent(initial, tmpl); err != nil {
+		return err
+	}
+	if client != nil {
+		return client.events(func(e event) error { return printEvent(e, tmpl) })
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	m := &monitor{last: readSnapshot(), infer: true}
+	ticker := time.NewTicker(monitorInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		for _, e := range m.poll() {
+			e.Time = time.Now()
+			if err := printEvent(e, tmpl); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// printEvent writes e as a JSON line, or through tmpl when given.
+func printEvent(e event, tmpl *template.Template) error {
+	if tmpl == nil {
+		return json.NewEncoder(os.Stdout).Encode(e)
+	}
+	if err := tmpl.Execute(os.Stdout, e); err != nil {
+		return err
+	}
+	fmt.Println()
+	return nil
+}
+
+// humanBytes formats a byte count for status bars, e.g. 1.5G.
+func humanBytes(n uint64) string {
+	const units = "KMGTPE"
+	if n < 1024 {
+		return fmt.Sprintf("%dB", n)
+	}
+	value, unit := float64(n)/1024, 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f%c", value, units[unit])
+}
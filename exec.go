@@ -1,13 +1,19 @@
 package main
 
 import (
+	"fmt"
+	"log/slog"
+	"net"
 	"os/exec"
 	"regexp"
 	"strings"
+	"time"
 )
 
 const defaultWGPort = "51820"
 
+// getEndpointIP returns the destination of the priority 219 rule in the
+// output of `ip rule show`, or "".
 func getEndpointIP(lines []string) string {
 	re := regexp.MustCompile(`^219.*from all to ([0-9]{1,3}\.[0-9]{1,3}\.[0-9]{1,3}\.[0-9]{1,3}) lookup main$`)
 	for _, line := range lines {
@@ -15,18 +21,18 @@ func getEndpointIP(lines []string) string {
 			return trim(matches[1])
 		}
 	}
-	panicer("no IP found:\n" + strings.Join(lines, "\n"))
 	return ""
 }
-func run(command ...string) (string, error, int) {
-	cmd := exec.Command(command[0], command[1:]...)
-	output, err := cmd.CombinedOutput()
+
+// logCommand records an external command; arguments and output are
+// redacted by the log handler.
+func logCommand(command []string, output []byte, err error, took time.Duration) {
+	args := strings.Join(command, " ")
 	if err != nil {
-		dumper(command)
-		dumper(string(output))
-		panicer(err)
+		slog.Error("command failed", "cmd", args, "err", err, "output", trim(string(output)), "took", took)
+		return
 	}
-	return string(output), err, cmd.ProcessState.ExitCode()
+	slog.Debug("command", "cmd", args, "took", took)
 }
 
 func isWGInterfaceExists(interfaceName string) bool {
@@ -35,37 +41,220 @@ func isWGInterfaceExists(interfaceName string) bool {
 	return err == nil
 }
 
-func execWGdown(interfaceName, interfaceIP string) error {
-	run("ip", "route", "delete", "default", "dev", interfaceName, "table", "212450")
-	out, _, _ := run("ip", "rule", "show")
-	run("ip", "rule", "delete", "to", getEndpointIP(strings.Split(out, "\n")), "table", "main", "priority", "219")
-	run("ip", "rule", "delete", "lookup", "212450", "priority", "220")
-	run("ip", "link", "set", "down", "dev", interfaceName)
-	run("ip", "address", "del", interfaceIP, "dev", interfaceName)
-	run("ip", "link", "delete", "dev", interfaceName)
-	return nil
+// Tunnel interfaces and their routing tables. Normally only the first is in
+// use; switch brings up the other one next to it before tearing down the old.
+var tunnelInterfaces = []string{"norrvpn01", "norrvpn02"}
+
+// Routing tables of norrvpn01 and norrvpn02.
+const (
+	primaryTable   = "212450"
+	secondaryTable = "212451"
+)
+
+func routingTable(interfaceName string) string {
+	if interfaceName == "norrvpn02" {
+		return secondaryTable
+	}
+	return primaryTable
 }
 
-func execWGup(interfaceName, privateKey, publicKey, endpointIP, interfaceIP string) error {
-	var cmd *exec.Cmd
-	cmd = exec.Command("ip", "link", "show", interfaceName)
-	cmd.Run()
-	if cmd.ProcessState.ExitCode() == 1 {
-		cmd = exec.Command("ip", "link", "add", "dev", interfaceName, "type", "wireguard")
-		panicer(cmd.Run())
-	}
-	cmd = exec.Command("wg", "set", interfaceName, "private-key", "/dev/stdin")
-	cmd.Stdin = strings.NewReader(privateKey)
-	b, err := cmd.CombinedOutput()
+// activeInterface returns the tunnel interface that is up, or "".
+func activeInterface() string {
+	for _, name := range tunnelInterfaces {
+		if isWGInterfaceExists(name) {
+			return name
+		}
+	}
+	return ""
+}
+
+// interfaceEndpoint returns the peer endpoint IP configured on interfaceName,
+// falling back to the priority 219 rule, or "" when neither is there.
+func interfaceEndpoint(interfaceName string) string {
+	if host := wgEndpoint(interfaceName); host != "" {
+		return host
+	}
+	rules, err := exec.Command("ip", "rule", "show").Output()
 	if err != nil {
-		dumper(string(b))
-		panicer(err)
-	}
-	run("wg", "set", interfaceName, "peer", publicKey, "endpoint", endpointIP+":"+defaultWGPort, "allowed-ips", "0.0.0.0/0")
-	run("ip", "address", "add", interfaceIP, "dev", interfaceName)
-	run("ip", "link", "set", "up", "dev", interfaceName)
-	run("ip", "route", "add", "default", "dev", interfaceName, "table", "212450")
-	run("ip", "rule", "add", "to", endpointIP, "table", "main", "priority", "219")
-	run("ip", "rule", "add", "lookup", "212450", "priority", "220")
+		return ""
+	}
+	return getEndpointIP(strings.Split(string(rules), "\n"))
+}
+
+// wgEndpoint returns the peer endpoint IP configured on interfaceName, or ""
+// when it has none or cannot be read.
+func wgEndpoint(interfaceName string) string {
+	out, err := exec.Command("wg", "show", interfaceName, "endpoints").Output()
+	if err != nil {
+		return ""
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) != 2 {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(fields[1])
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
+// netOp is one change to the network, as the ip or wg command that makes
+// it. Tunnel changes are built from netOps so that --dry-run can print them
+// instead.
+type netOp struct {
+	args []string
+	// stdin is fed to the command; it carries the private key and is
+	// never printed.
+	stdin string
+	// undo reverts the change, for ops that add something.
+	undo []string
+}
+
+func newNetOp(args ...string) netOp {
+	return netOp{args: args}
+}
+
+func (o netOp) String() string {
+	return strings.Join(o.args, " ")
+}
+
+func (o netOp) exec() error {
+	cmd := exec.Command(o.args[0], o.args[1:]...)
+	if o.stdin != "" {
+		cmd.Stdin = strings.NewReader(o.stdin)
+	}
+	start := time.Now()
+	output, err := cmd.CombinedOutput()
+	logCommand(o.args, output, err, time.Since(start))
+	if err != nil {
+		return fmt.Errorf("%s: %w: %s", o, err, trim(string(output)))
+	}
 	return nil
 }
+
+// withUndo returns o with the command that reverts it.
+func (o netOp) withUndo(args ...string) netOp {
+	o.undo = args
+	return o
+}
+
+// apply makes the changes in order, or prints them under --dry-run. On the
+// first failure it reverts the changes it made, latest first, and returns
+// the error.
+func apply(ops ...netOp) error {
+	for i, o := range ops {
+		if *dryRunFlag {
+			fmt.Fprintln(output, o)
+			continue
+		}
+		if err := o.exec(); err != nil {
+			for j := i - 1; j >= 0; j-- {
+				if ops[j].undo != nil {
+					newNetOp(ops[j].undo...).exec()
+				}
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// endpointRule adds or deletes the priority 219 rule that keeps the
+// encrypted traffic to endpointIP in the main table.
+func endpointRule(action, endpointIP string) netOp {
+	o := newNetOp("ip", "rule", action, "to", endpointIP, "table", "main", "priority", "219")
+	if action == "add" {
+		o.undo = endpointRule("delete", endpointIP).args
+	}
+	return o
+}
+
+// tunnelRule adds or deletes the priority 220 rule that sends everything
+// else to the table of a tunnel interface.
+func tunnelRule(action, table string) netOp {
+	o := newNetOp("ip", "rule", action, "lookup", table, "priority", "220")
+	if action == "add" {
+		o.undo = tunnelRule("delete", table).args
+	}
+	return o
+}
+
+// execWGdown removes the tunnel. It stops at the first failure and leaves
+// the rest to 'norrvpn repair'.
+func execWGdown(interfaceName, interfaceIP string) error {
+	table := routingTable(interfaceName)
+	ops := []netOp{newNetOp("ip", "route", "delete", "default", "dev", interfaceName, "table", table)}
+	if endpointIP := interfaceEndpoint(interfaceName); endpointIP != "" {
+		ops = append(ops, endpointRule("delete", endpointIP))
+	}
+	ops = append(ops, tunnelRule("delete", table))
+	return apply(append(ops, linkDownOps(interfaceName, interfaceIP)...)...)
+}
+
+// execWGup brings the tunnel up; after a failure nothing of it is left.
+func execWGup(interfaceName, privateKey, publicKey, endpointIP, interfaceIP string) error {
+	ops := linkUpOps(interfaceName, privateKey, publicKey, endpointIP, interfaceIP)
+	return apply(append(ops, endpointRule("add", endpointIP), tunnelRule("add", routingTable(interfaceName)))...)
+}
+
+// linkUpOps configure the interface and the default route in its table, but
+// do not route any traffic to it yet.
+func linkUpOps(interfaceName, privateKey, publicKey, endpointIP, interfaceIP string) []netOp {
+	var ops []netOp
+	if !isWGInterfaceExists(interfaceName) {
+		ops = append(ops, newNetOp("ip", "link", "add", "dev", interfaceName, "type", "wireguard").
+			withUndo("ip", "link", "delete", "dev", interfaceName))
+	}
+	table := routingTable(interfaceName)
+	return append(ops, privateKeyOp(interfaceName, privateKey),
+		// The keepalive makes the peer handshake right away and keeps
+		// rekeying while idle, so a stale handshake means the tunnel is
+		// broken.
+		newNetOp("wg", "set", interfaceName, "peer", publicKey, "endpoint", endpointIP+":"+defaultWGPort,
+			"allowed-ips", "0.0.0.0/0", "persistent-keepalive", "25").
+			withUndo("wg", "set", interfaceName, "peer", publicKey, "remove"),
+		newNetOp("ip", "address", "add", interfaceIP, "dev", interfaceName).
+			withUndo("ip", "address", "del", interfaceIP, "dev", interfaceName),
+		newNetOp("ip", "link", "set", "up", "dev", interfaceName).
+			withUndo("ip", "link", "set", "down", "dev", interfaceName),
+		newNetOp("ip", "route", "add", "default", "dev", interfaceName, "table", table).
+			withUndo("ip", "route", "delete", "default", "dev", interfaceName, "table", table),
+	)
+}
+
+// privateKeyOp sets the private key of interfaceName; the key is passed on
+// standard input.
+func privateKeyOp(interfaceName, privateKey string) netOp {
+	o := newNetOp("wg", "set", interfaceName, "private-key", "/dev/stdin")
+	o.stdin = privateKey
+	return o
+}
+
+func linkDownOps(interfaceName, interfaceIP string) []netOp {
+	return []netOp{
+		newNetOp("ip", "link", "set", "down", "dev", interfaceName),
+		newNetOp("ip", "address", "del", interfaceIP, "dev", interfaceName),
+		newNetOp("ip", "link", "delete", "dev", interfaceName),
+	}
+}
+
+// waitForHandshake polls the peer of interfaceName until a handshake has
+// completed or timeout expires.
+func waitForHandshake(interfaceName string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		out, err := exec.Command("wg", "show", interfaceName, "latest-handshakes").Output()
+		if err != nil {
+			return err
+		}
+		fields := strings.Fields(string(out))
+		if len(fields) == 2 && fields[1] != "0" {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("no handshake on %s within %s", interfaceName, timeout)
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
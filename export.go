@@ -0,0 +1,450 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const defaultNordvpnDNS = "103.86.96.100,103.86.99.100"
+
+// wgConfig describes one NordLynx tunnel; every export format is a rendering
+// of it.
+type wgConfig struct {
+	Name                string   `json:"name"`
+	Server              string   `json:"server"`
+	Hostname            string   `json:"hostname"`
+	Country             string   `json:"country"`
+	PrivateKey          string   `json:"private_key"`
+	Address             string   `json:"address"`
+	DNS                 []string `json:"dns,omitempty"`
+	MTU                 int      `json:"mtu,omitempty"`
+	PublicKey           string   `json:"public_key"`
+	Endpoint            string   `json:"endpoint"`
+	EndpointIP          string   `json:"endpoint_ip"`
+	Port                string   `json:"port"`
+	AllowedIPs          []string `json:"allowed_ips"`
+	PersistentKeepalive int      `json:"persistent_keepalive,omitempty"`
+}
+
+// exportFile is one file of an export. Formats that need several files,
+// like systemd-networkd, tell them apart by suffix.
+type exportFile struct {
+	suffix  string
+	content string
+}
+
+// exportFormat renders a config; ext names files written by --dir.
+type exportFormat struct {
+	ext    string
+	render func(wgConfig) []exportFile
+}
+
+var exportFormats = map[string]exportFormat{
+	"wg-quick":         {".conf", renderWGQuick},
+	"wg":               {".conf", renderWG},
+	"networkmanager":   {".nmconnection", renderNetworkManager},
+	"systemd-networkd": {"", renderNetworkd},
+	"openwrt":          {".sh", renderOpenWrt},
+	"mikrotik":         {".rsc", renderMikroTik},
+	"json":             {".json", renderJSON},
+}
+
+func exportFormatNames() []string {
+	names := make([]string, 0, len(exportFormats))
+	for name := range exportFormats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// exportOptions holds the flags shaping the generated config.
+type exportOptions struct {
+	format       string
+	name         string
+	dns          string
+	mtu          int
+	keepalive    int
+	allowedIPs   string
+	endpointHost bool
+	out          string
+	dir          string
+	count        int
+	qr           bool
+	qrFile       string
+}
+
+func (o *exportOptions) register(cmd *command) {
+	fs := cmd.flags
+	fs.StringVar(&o.format, "format", "wg-quick", "Config format: "+strings.Join(exportFormatNames(), ", "))
+	fs.StringVar(&o.name, "name", "norrvpn", "Interface or connection name used in the config")
+	fs.StringVar(&o.dns, "dns", defaultNordvpnDNS, "Comma separated DNS servers, empty for none")
+	fs.IntVar(&o.mtu, "mtu", 1420, "Interface MTU, 0 to leave unset")
+	fs.IntVar(&o.keepalive, "keepalive", 25, "Persistent keepalive in seconds, 0 to disable")
+	fs.StringVar(&o.allowedIPs, "allowed-ips", "0.0.0.0/0", "Comma separated networks routed through the tunnel")
+	fs.BoolVar(&o.endpointHost, "endpoint-hostname", false, "Use the server hostname instead of its IP as endpoint")
+	fs.StringVar(&o.out, "out", "", "Write to this file (mode 0600) instead of stdout")
+	fs.StringVar(&o.dir, "dir", "", "Write one file per server into this directory")
+	fs.IntVar(&o.count, "count", 1, "Number of servers to export, best first")
+	fs.BoolVar(&o.qr, "qr", false, "Show the config as a QR code in the terminal")
+	fs.StringVar(&o.qrFile, "qr-file", "", "Write the config as a QR code PNG to this file")
+
+	cmd.completeFlags["format"] = func(*completionContext) []string { return exportFormatNames() }
+}
+
+func (o *exportOptions) validate(cmd *command) error {
+	if _, ok := exportFormats[o.format]; !ok {
+		return cmd.usagef("unknown format %q, expected one of %s", o.format, strings.Join(exportFormatNames(), ", "))
+	}
+	if o.mtu < 0 || o.keepalive < 0 {
+		return cmd.usagef("--mtu and --keepalive must not be negative")
+	}
+	if o.count < 1 {
+		return cmd.usagef("--count must be at least 1")
+	}
+	if o.out != "" && o.dir != "" {
+		return cmd.usagef("--out and --dir are mutually exclusive")
+	}
+	if o.count > 1 && o.dir == "" {
+		return cmd.usagef("--count above 1 requires --dir")
+	}
+	if o.qr || o.qrFile != "" {
+		if o.format != "wg-quick" {
+			return cmd.usagef("QR codes are only available for the wg-quick format")
+		}
+		if o.dir != "" {
+			return cmd.usagef("QR codes cannot be combined with --dir")
+		}
+	}
+	return nil
+}
+
+func (o *exportOptions) config(server Server, privateKey string) wgConfig {
+	cfg := wgConfig{
+		Name:                o.name,
+		Server:              server.Name,
+		Hostname:            server.Hostname,
+		PrivateKey:          privateKey,
+		Address:             defaultNordvpnAddress,
+		DNS:                 splitList(o.dns),
+		MTU:                 o.mtu,
+		PublicKey:           serverPublicKey(server),
+		Endpoint:            server.Station,
+		EndpointIP:          server.Station,
+		Port:                defaultWGPort,
+		AllowedIPs:          splitList(o.allowedIPs),
+		PersistentKeepalive: o.keepalive,
+	}
+	if len(server.Locations) > 0 {
+		cfg.Country = strings.ToLower(server.Locations[0].Country.Code)
+	}
+	if o.endpointHost || cfg.Endpoint == "" {
+		cfg.Endpoint = server.Hostname
+	}
+	return cfg
+}
+
+// write renders cfg and writes it to o.out, or to stdout when unset. For
+// multi-file formats o.out is the base name the suffixes are appended to.
+func (o *exportOptions) write(cfg wgConfig) error {
+	files := exportFormats[o.format].render(cfg)
+	if o.out == "" {
+		for _, file := range files {
+			if len(files) > 1 {
+				fmt.Printf("# --- %s%s ---\n", cfg.Name, file.suffix)
+			}
+			fmt.Print(file.content)
+		}
+		return nil
+	}
+	for _, file := range files {
+		if err := writePrivateFile(o.out+file.suffix, []byte(file.content)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeQR renders cfg as a wg-quick config in a QR code, as imported by the
+// WireGuard mobile apps. The config itself is still written to --out.
+func (o *exportOptions) writeQR(cfg wgConfig) error {
+	if o.out != "" {
+		if err := o.write(cfg); err != nil {
+			return err
+		}
+	}
+	qr, err := encodeQR([]byte(renderWGQuick(cfg)[0].content), qrLevelL)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stderr, "Warning: the QR code contains your WireGuard private key. Anyone who scans it can use your NordVPN account.")
+	if o.qr {
+		fmt.Print(qr.terminal(2))
+	}
+	if o.qrFile != "" {
+		return qr.writePNG(o.qrFile, 8, 4)
+	}
+	return nil
+}
+
+// writeDir writes one config per server into o.dir, named after the short
+// hostname. With several servers each config gets its own interface name.
+func (o *exportOptions) writeDir(servers Servers, privateKey string) error {
+	if err := os.MkdirAll(o.dir, 0700); err != nil {
+		return err
+	}
+	for _, server := range servers {
+		short, _, _ := strings.Cut(server.Hostname, ".")
+		cfg := o.config(server, privateKey)
+		if len(servers) > 1 {
+			cfg.Name = o.name + "-" + short
+		}
+		path := filepath.Join(o.dir, short+exportFormats[o.format].ext)
+		for _, file := range exportFormats[o.format].render(cfg) {
+			if err := writePrivateFile(path+file.suffix, []byte(file.content)); err != nil {
+				return err
+			}
+			fmt.Printf("Wrote %s\n", path+file.suffix)
+		}
+	}
+	return nil
+}
+
+func serverPublicKey(server Server) string {
+	for _, tech := range server.Technologies {
+		if tech.Identifier == "wireguard_udp" && len(tech.Metadata) > 0 {
+			return tech.Metadata[0].Value
+		}
+	}
+	return ""
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = trim(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func newExportCommand() *command {
+	cmd := newCommand("export", "[cc] [city]", "Export current connection, or servers from the API, as WireGuard config")
+	var selection serverSelection
+	selection.register(cmd)
+	var opts exportOptions
+	opts.register(cmd)
+	cmd.run = func(args []string) error {
+		if err := opts.validate(cmd); err != nil {
+			return err
+		}
+
+		// Without a location, export the current connection when there is one
+		// and the recommended server otherwise.
+		var servers Servers
+		if len(args) == 0 && selection == (serverSelection{}) && opts.count == 1 && activeInterface() != "" {
+			server, err := loadServerInfo()
+			if err != nil {
+				return fmt.Errorf("loading server info: %w", err)
+			}
+			servers = Servers{server}
+		} else {
+			filter, err := selection.filter(cmd, args)
+			if err != nil {
+				return err
+			}
+			servers, err = fetchServerList(filter, opts.count)
+			if err != nil {
+				return err
+			}
+			if len(servers) == 0 {
+				return fmt.Errorf("no servers found for the specified criteria")
+			}
+		}
+
+		privateKey, err := ownPrivateKey()
+		if err != nil {
+			return err
+		}
+		if opts.dir != "" {
+			return opts.writeDir(servers, privateKey)
+		}
+		cfg := opts.config(servers[0], privateKey)
+		if opts.qr || opts.qrFile != "" {
+			return opts.writeQR(cfg)
+		}
+		return opts.write(cfg)
+	}
+	return cmd
+}
+
+func renderWGQuick(cfg wgConfig) []exportFile {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# wg config for %s (%s)\n", cfg.Server, cfg.Country)
+	b.WriteString("[Interface]\n")
+	fmt.Fprintf(&b, "Address = %s\n", cfg.Address)
+	fmt.Fprintf(&b, "PrivateKey = %s\n", cfg.PrivateKey)
+	if len(cfg.DNS) > 0 {
+		fmt.Fprintf(&b, "DNS = %s\n", strings.Join(cfg.DNS, ", "))
+	}
+	if cfg.MTU > 0 {
+		fmt.Fprintf(&b, "MTU = %d\n", cfg.MTU)
+	}
+	b.WriteString("\n")
+	writeWGPeer(&b, cfg)
+	return []exportFile{{content: b.String()}}
+}
+
+// renderWG produces the `wg setconf` format, which has no Address, DNS or
+// MTU keys.
+func renderWG(cfg wgConfig) []exportFile {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# wg config for %s (%s)\n", cfg.Server, cfg.Country)
+	b.WriteString("[Interface]\n")
+	fmt.Fprintf(&b, "PrivateKey = %s\n\n", cfg.PrivateKey)
+	writeWGPeer(&b, cfg)
+	return []exportFile{{content: b.String()}}
+}
+
+func writeWGPeer(b *strings.Builder, cfg wgConfig) {
+	b.WriteString("[Peer]\n")
+	fmt.Fprintf(b, "PublicKey = %s\n", cfg.PublicKey)
+	fmt.Fprintf(b, "AllowedIPs = %s\n", strings.Join(cfg.AllowedIPs, ", "))
+	fmt.Fprintf(b, "Endpoint = %s:%s\n", cfg.Endpoint, cfg.Port)
+	if cfg.PersistentKeepalive > 0 {
+		fmt.Fprintf(b, "PersistentKeepalive = %d\n", cfg.PersistentKeepalive)
+	}
+}
+
+// renderNetworkManager produces a keyfile for
+// /etc/NetworkManager/system-connections/<name>.nmconnection.
+func renderNetworkManager(cfg wgConfig) []exportFile {
+	var b strings.Builder
+	fmt.Fprintf(&b, "[connection]\nid=%s\ntype=wireguard\ninterface-name=%s\n\n", cfg.Name, cfg.Name)
+	b.WriteString("[wireguard]\n")
+	if cfg.MTU > 0 {
+		fmt.Fprintf(&b, "mtu=%d\n", cfg.MTU)
+	}
+	fmt.Fprintf(&b, "private-key=%s\n\n", cfg.PrivateKey)
+	fmt.Fprintf(&b, "[wireguard-peer.%s]\n", cfg.PublicKey)
+	fmt.Fprintf(&b, "endpoint=%s:%s\n", cfg.Endpoint, cfg.Port)
+	if cfg.PersistentKeepalive > 0 {
+		fmt.Fprintf(&b, "persistent-keepalive=%d\n", cfg.PersistentKeepalive)
+	}
+	fmt.Fprintf(&b, "allowed-ips=%s;\n\n", strings.Join(cfg.AllowedIPs, ";"))
+	fmt.Fprintf(&b, "[ipv4]\naddress1=%s\n", cfg.Address)
+	if len(cfg.DNS) > 0 {
+		fmt.Fprintf(&b, "dns=%s;\ndns-search=~;\nignore-auto-dns=true\n", strings.Join(cfg.DNS, ";"))
+	}
+	b.WriteString("method=manual\n\n[ipv6]\naddr-gen-mode=default\nmethod=disabled\n")
+	return []exportFile{{content: b.String()}}
+}
+
+// renderNetworkd produces a .netdev and a .network file that route traffic
+// the same way `norrvpn up` does: a default route in its own table and
+// rules keeping the endpoint on the main table.
+func renderNetworkd(cfg wgConfig) []exportFile {
+	var netdev strings.Builder
+	fmt.Fprintf(&netdev, "[NetDev]\nName=%s\nKind=wireguard\n", cfg.Name)
+	if cfg.MTU > 0 {
+		fmt.Fprintf(&netdev, "MTUBytes=%d\n", cfg.MTU)
+	}
+	fmt.Fprintf(&netdev, "\n[WireGuard]\nPrivateKey=%s\n\n", cfg.PrivateKey)
+	fmt.Fprintf(&netdev, "[WireGuardPeer]\nPublicKey=%s\nEndpoint=%s:%s\n", cfg.PublicKey, cfg.Endpoint, cfg.Port)
+	for _, allowed := range cfg.AllowedIPs {
+		fmt.Fprintf(&netdev, "AllowedIPs=%s\n", allowed)
+	}
+	if cfg.PersistentKeepalive > 0 {
+		fmt.Fprintf(&netdev, "PersistentKeepalive=%d\n", cfg.PersistentKeepalive)
+	}
+
+	var network strings.Builder
+	fmt.Fprintf(&network, "[Match]\nName=%s\n\n[Network]\nAddress=%s\n", cfg.Name, cfg.Address)
+	for _, dns := range cfg.DNS {
+		fmt.Fprintf(&network, "DNS=%s\n", dns)
+	}
+	if len(cfg.DNS) > 0 {
+		network.WriteString("Domains=~.\nDNSDefaultRoute=yes\n")
+	}
+	for _, allowed := range cfg.AllowedIPs {
+		fmt.Fprintf(&network, "\n[Route]\nDestination=%s\nTable=%s\n", allowed, primaryTable)
+	}
+	if cfg.EndpointIP != "" {
+		fmt.Fprintf(&network, "\n[RoutingPolicyRule]\nTo=%s/32\nTable=main\nPriority=219\n", cfg.EndpointIP)
+	}
+	fmt.Fprintf(&network, "\n[RoutingPolicyRule]\nTable=%s\nPriority=220\n", primaryTable)
+
+	return []exportFile{
+		{suffix: ".netdev", content: netdev.String()},
+		{suffix: ".network", content: network.String()},
+	}
+}
+
+// renderOpenWrt produces uci commands; firewall zones are left to the user.
+func renderOpenWrt(cfg wgConfig) []exportFile {
+	var b strings.Builder
+	iface := "network." + cfg.Name
+	peer := "network.@wireguard_" + cfg.Name + "[-1]"
+	fmt.Fprintf(&b, "# wg config for %s (%s)\n", cfg.Server, cfg.Country)
+	fmt.Fprintf(&b, "uci set %s=interface\n", iface)
+	fmt.Fprintf(&b, "uci set %s.proto='wireguard'\n", iface)
+	fmt.Fprintf(&b, "uci set %s.private_key='%s'\n", iface, cfg.PrivateKey)
+	fmt.Fprintf(&b, "uci add_list %s.addresses='%s'\n", iface, cfg.Address)
+	if cfg.MTU > 0 {
+		fmt.Fprintf(&b, "uci set %s.mtu='%d'\n", iface, cfg.MTU)
+	}
+	for _, dns := range cfg.DNS {
+		fmt.Fprintf(&b, "uci add_list %s.dns='%s'\n", iface, dns)
+	}
+	fmt.Fprintf(&b, "uci add network wireguard_%s\n", cfg.Name)
+	fmt.Fprintf(&b, "uci set %s.description='%s'\n", peer, cfg.Server)
+	fmt.Fprintf(&b, "uci set %s.public_key='%s'\n", peer, cfg.PublicKey)
+	fmt.Fprintf(&b, "uci set %s.endpoint_host='%s'\n", peer, cfg.Endpoint)
+	fmt.Fprintf(&b, "uci set %s.endpoint_port='%s'\n", peer, cfg.Port)
+	if cfg.PersistentKeepalive > 0 {
+		fmt.Fprintf(&b, "uci set %s.persistent_keepalive='%d'\n", peer, cfg.PersistentKeepalive)
+	}
+	fmt.Fprintf(&b, "uci set %s.route_allowed_ips='1'\n", peer)
+	for _, allowed := range cfg.AllowedIPs {
+		fmt.Fprintf(&b, "uci add_list %s.allowed_ips='%s'\n", peer, allowed)
+	}
+	b.WriteString("uci commit network\n")
+	return []exportFile{{content: b.String()}}
+}
+
+// renderMikroTik produces RouterOS 7 commands; routing through the tunnel is
+// left to the user.
+func renderMikroTik(cfg wgConfig) []exportFile {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# wg config for %s (%s)\n", cfg.Server, cfg.Country)
+	fmt.Fprintf(&b, "/interface wireguard add name=%s", cfg.Name)
+	if cfg.MTU > 0 {
+		fmt.Fprintf(&b, " mtu=%d", cfg.MTU)
+	}
+	fmt.Fprintf(&b, " private-key=\"%s\"\n", cfg.PrivateKey)
+	fmt.Fprintf(&b, "/interface wireguard peers add interface=%s public-key=\"%s\" endpoint-address=%s endpoint-port=%s allowed-address=%s",
+		cfg.Name, cfg.PublicKey, cfg.Endpoint, cfg.Port, strings.Join(cfg.AllowedIPs, ","))
+	if cfg.PersistentKeepalive > 0 {
+		fmt.Fprintf(&b, " persistent-keepalive=%ds", cfg.PersistentKeepalive)
+	}
+	fmt.Fprintf(&b, " comment=\"%s\"\n", cfg.Server)
+	fmt.Fprintf(&b, "/ip address add address=%s interface=%s\n", cfg.Address, cfg.Name)
+	if len(cfg.DNS) > 0 {
+		// This replaces the router's DNS servers for everything, not only
+		// for the tunnel, so it is left for the user to enable.
+		b.WriteString("# Uncomment to replace the router's DNS servers for all clients:\n")
+		fmt.Fprintf(&b, "# /ip dns set servers=%s\n", strings.Join(cfg.DNS, ","))
+	}
+	return []exportFile{{content: b.String()}}
+}
+
+func renderJSON(cfg wgConfig) []exportFile {
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	panicer(err)
+	return []exportFile{{content: string(data) + "\n"}}
+}
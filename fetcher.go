@@ -2,85 +2,156 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
 	"net/http"
+	"net/url"
+	"strconv"
 )
 
-func FetchServerData(countryID int, cityID int) (string, string, Server) {
-	url := "https://api.nordvpn.com/v1/servers/recommendations?filters[servers_technologies][identifier]=wireguard_udp"
-	if countryID > 0 {
-		url += fmt.Sprintf("&filters[country_id]=%d", countryID)
-	}
+// serverFilter narrows down the servers FetchServerData picks from. Zero
+// values mean "any".
+type serverFilter struct {
+	CountryID int    `json:"country_id,omitempty"`
+	CityID    int    `json:"city_id,omitempty"`
+	Group     string `json:"group,omitempty"`
+	Hostname  string `json:"hostname,omitempty"`
+}
 
-	if cityID <= 0 {
-		url += "&limit=1"
-	} else {
-		url += "&limit=16384"
+func FetchServerData(filter serverFilter) (string, string, Server) {
+	servers, err := fetchServerList(filter, 1)
+	panicer(err)
+	if len(servers) == 0 {
+		if filter.CityID > 0 {
+			panicer(fmt.Errorf("no servers found in the specified city"))
+		}
+		panicer(fmt.Errorf("no servers found for the specified criteria"))
 	}
+	selectedServer := servers[0]
+	slog.Info("server selected", "server", selectedServer.Hostname, "load", selectedServer.Load,
+		"country", filter.CountryID, "city", filter.CityID, "group", filter.Group)
 
-	resp, err := http.Get(url)
+	ip, publicKey, err := serverEndpoint(selectedServer)
 	panicer(err)
+	return ip, publicKey, selectedServer
+}
+
+// serverEndpoint resolves the WireGuard endpoint IP and public key of server.
+func serverEndpoint(server Server) (string, string, error) {
+	ips, err := net.LookupIP(server.Hostname)
+	if err != nil {
+		return "", "", err
+	}
+	return ips[0].String(), serverPublicKey(server), nil
+}
+
+// serverListURL builds the query with url.Values, as the filter can come
+// from daemon clients.
+func serverListURL(filter serverFilter, limit int) string {
+	endpoint := "https://api.nordvpn.com/v1/servers/recommendations"
+	query := url.Values{}
+	query.Set("filters[servers_technologies][identifier]", "wireguard_udp")
+	if filter.Hostname != "" {
+		endpoint = "https://api.nordvpn.com/v1/servers"
+		query = url.Values{}
+		query.Set("filters[hostname]", filter.Hostname)
+	}
+	if filter.CountryID > 0 {
+		query.Set("filters[country_id]", strconv.Itoa(filter.CountryID))
+	}
+	if filter.Group != "" {
+		query.Set("filters[servers_groups][identifier]", filter.Group)
+	}
+	// The API cannot filter by city, so fetch everything and filter here.
+	if filter.CityID > 0 {
+		limit = 16384
+	}
+	query.Set("limit", strconv.Itoa(limit))
+	return endpoint + "?" + query.Encode()
+}
+
+// fetchServerList returns up to limit servers matching filter, best first.
+func fetchServerList(filter serverFilter, limit int) (Servers, error) {
+	resp, err := apiClient.Get(serverListURL(filter, limit))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching servers: %s", resp.Status)
+	}
 	data, err := io.ReadAll(resp.Body)
-	panicer(err)
+	if err != nil {
+		return nil, err
+	}
 	servers := Servers{}
-	err = json.Unmarshal(data, &servers)
-	panicer(err)
-
-	if len(servers) == 0 {
-		panicer(fmt.Errorf("no servers found for the specified criteria"))
+	if err := json.Unmarshal(data, &servers); err != nil {
+		return nil, err
 	}
+	rememberServers(servers)
 
-	var selectedServer Server
-	if cityID > 0 {
-		found := false
+	if filter.CityID > 0 {
+		var inCity Servers
 		for _, server := range servers {
 			for _, location := range server.Locations {
-				if location.Country.City.ID == cityID {
-					selectedServer = server
-					found = true
+				if location.Country.City.ID == filter.CityID {
+					inCity = append(inCity, server)
 					break
 				}
 			}
-			if found {
-				break
-			}
-		}
-		if !found {
-			panicer(fmt.Errorf("no servers found in the specified city"))
 		}
-	} else {
-		selectedServer = servers[0]
+		servers = inCity
 	}
-
-	hostname := selectedServer.Hostname
-	var publicKey string
-
-	for _, technology := range selectedServer.Technologies {
-		if technology.Identifier != "wireguard_udp" {
-			continue
-		}
-		publicKey = technology.Metadata[0].Value
+	if len(servers) > limit {
+		servers = servers[:limit]
 	}
-	ips, err := net.LookupIP(hostname)
-	panicer(err)
-	return ips[0].String(), publicKey, selectedServer
+	return servers, nil
 }
 
-func fetchOwnPrivateKey(token string) string {
+var (
+	errTokenRejected = errors.New("token is invalid or expired")
+	errNoVPNService  = errors.New("token has no access to NordVPN credentials, is the subscription active?")
+)
+
+func fetchCredentials(token string) (Creds, error) {
+	registerSecret(token)
 	url := "https://api.nordvpn.com/v1/users/services/credentials"
 	req, err := http.NewRequest("GET", url, nil)
-	panicer(err)
+	if err != nil {
+		return Creds{}, err
+	}
 	req.SetBasicAuth("token", token)
-	resp, err := http.DefaultClient.Do(req)
-	panicer(err)
+	resp, err := apiClient.Do(req)
+	if err != nil {
+		return Creds{}, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized:
+		return Creds{}, errTokenRejected
+	case http.StatusForbidden, http.StatusNotFound:
+		return Creds{}, errNoVPNService
+	default:
+		return Creds{}, fmt.Errorf("fetching credentials: %s", resp.Status)
+	}
 	data, err := io.ReadAll(resp.Body)
-	panicer(err)
-	servers := Creds{}
-	err = json.Unmarshal(data, &servers)
-	panicer(err)
-	return servers.NordlynxPrivateKey
+	if err != nil {
+		return Creds{}, err
+	}
+	creds := Creds{}
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return Creds{}, err
+	}
+	registerSecret(creds.NordlynxPrivateKey)
+	registerSecret(creds.Password)
+	if creds.NordlynxPrivateKey == "" {
+		return Creds{}, errors.New("credentials response has no NordLynx private key")
+	}
+	return creds, nil
 }
 
 type Creds struct {
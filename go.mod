@@ -3,13 +3,10 @@ module norrvpn
 go 1.23.1
 
 require (
-	github.com/davecgh/go-spew v1.1.1
+	github.com/godbus/dbus/v5 v5.1.0
 	github.com/olekukonko/tablewriter v0.0.5
-	golang.org/x/crypto v0.28.0
+	golang.org/x/sys v0.26.0
 	golang.org/x/term v0.25.0
 )
 
-require (
-	github.com/mattn/go-runewidth v0.0.9 // indirect
-	golang.org/x/sys v0.26.0 // indirect
-)
+require github.com/mattn/go-runewidth v0.0.9 // indirect
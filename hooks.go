@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var hooksPath = tokenPath + "/hooks.d"
+
+const hookTimeout = 30 * time.Second
+
+// Hook phases.
+const (
+	preUp    = "pre-up"
+	postUp   = "post-up"
+	preDown  = "pre-down"
+	postDown = "post-down"
+)
+
+// hookInfo describes the tunnel change hooks run for; it is passed to them
+// as NORRVPN_* environment variables.
+type hookInfo struct {
+	iface    string
+	server   Server
+	endpoint string
+	reason   string // up, down, switch, rotate, overload, reconnect or repair
+}
+
+func (h hookInfo) env(phase string) []string {
+	var country, city string
+	if len(h.server.Locations) > 0 {
+		country = h.server.Locations[0].Country.Code
+		city = h.server.Locations[0].Country.City.Name
+	}
+	return append(os.Environ(),
+		"NORRVPN_PHASE="+phase,
+		"NORRVPN_REASON="+h.reason,
+		"NORRVPN_INTERFACE="+h.iface,
+		"NORRVPN_SERVER_NAME="+h.server.Name,
+		"NORRVPN_HOSTNAME="+h.server.Hostname,
+		"NORRVPN_COUNTRY="+country,
+		"NORRVPN_CITY="+city,
+		"NORRVPN_ENDPOINT="+h.endpoint,
+	)
+}
+
+// trustedFile returns an error unless path belongs to the user norrvpn runs
+// as, usually root, and nobody else can write to it. The token directory
+// may belong to the user behind sudo, who must not get to run commands as
+// root through hooks.
+func trustedFile(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Errorf("%s: owner unknown", path)
+	}
+	if int(stat.Uid) != os.Geteuid() {
+		return fmt.Errorf("%s is owned by uid %d, not %d", path, stat.Uid, os.Geteuid())
+	}
+	if info.Mode().Perm()&0022 != 0 {
+		return fmt.Errorf("%s is writable by group or others", path)
+	}
+	return nil
+}
+
+// hookCommands lists the hooks of a phase: executables in hooks.d named
+// after it (pre-up, pre-up-firewall, pre-up.sh, ...) in lexical order,
+// followed by the shell commands from config.json. Hooks in untrusted
+// files are skipped, see trustedFile.
+func hookCommands(phase string) [][]string {
+	var cmds [][]string
+	var entries []os.DirEntry
+	if _, err := os.Stat(hooksPath); err == nil {
+		if err := trustedFile(hooksPath); err != nil {
+			slog.Warn("skipping hooks", "err", err)
+		} else {
+			entries, _ = os.ReadDir(hooksPath)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	for _, entry := range entries {
+		name := entry.Name()
+		if name != phase && !strings.HasPrefix(name, phase+"-") && !strings.HasPrefix(name, phase+".") {
+			continue
+		}
+		if strings.HasSuffix(name, "~") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() || info.Mode()&0111 == 0 {
+			continue
+		}
+		path := hooksPath + "/" + name
+		if err := trustedFile(path); err != nil {
+			slog.Warn("skipping hook", "err", err)
+			continue
+		}
+		cmds = append(cmds, []string{path})
+	}
+
+	cfg, err := loadConfig()
+	if err != nil || len(cfg.Hooks[phase]) == 0 {
+		return cmds
+	}
+	if err := trustedFile(configPath); err != nil {
+		slog.Warn("skipping hooks from config", "err", err)
+		return cmds
+	}
+	for _, line := range cfg.Hooks[phase] {
+		cmds = append(cmds, []string{"/bin/sh", "-c", line})
+	}
+	return cmds
+}
+
+// runHooks runs the hooks of phase one after another. The first failing
+// pre- hook stops and aborts the operation; post- hooks cannot undo the
+// change anymore, so their failures are only logged.
+func runHooks(phase string, info hookInfo) error {
+	for _, args := range hookCommands(phase) {
+		if *dryRunFlag {
+			fmt.Fprintf(output, "# %s hook: %s\n", phase, strings.Join(args, " "))
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+		hook := exec.CommandContext(ctx, args[0], args[1:]...)
+		hook.Env = info.env(phase)
+		hook.Stdout, hook.Stderr = output, errOutput
+		start := time.Now()
+		err := hook.Run()
+		cancel()
+		name := args[len(args)-1]
+		if err == nil {
+			slog.Info("hook", "phase", phase, "hook", name, "took", time.Since(start))
+			continue
+		}
+		err = fmt.Errorf("%s hook %s: %w", phase, name, err)
+		if strings.HasPrefix(phase, "pre-") {
+			return err
+		}
+		slog.Warn("hook failed", "err", err)
+		if errOutput != os.Stderr {
+			// The log only reaches the journal, not the daemon's client.
+			fmt.Fprintf(errOutput, "Warning: %v\n", err)
+		}
+	}
+	return nil
+}
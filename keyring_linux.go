@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// keyringStore keeps secrets in the kernel keyring, described as
+// "norrvpn:<name>". Keys live in kernel memory only, so the token has to be
+// stored again after a reboot.
+type keyringStore struct{}
+
+func (keyringStore) name() string {
+	return "keyring"
+}
+
+// keyringID returns the persistent keyring of the invoking user, which is
+// shared between sudo and the user's own shells. Kernels built without
+// persistent keyrings fall back to the user keyring of the process.
+func keyringID() (int, error) {
+	uid, _ := invokingUser()
+	id, err := unix.KeyctlInt(unix.KEYCTL_GET_PERSISTENT, uid, unix.KEY_SPEC_PROCESS_KEYRING, 0, 0)
+	if errors.Is(err, unix.EOPNOTSUPP) {
+		return unix.KEY_SPEC_USER_KEYRING, nil
+	}
+	return id, err
+}
+
+// keyringLifetime describes how long an unused persistent keyring is kept.
+func keyringLifetime() string {
+	data, err := os.ReadFile("/proc/sys/kernel/keys/persistent_keyring_expiry")
+	if err != nil {
+		return "3 days"
+	}
+	seconds, err := strconv.Atoi(trim(string(data)))
+	if err != nil {
+		return "3 days"
+	}
+	if seconds%86400 == 0 {
+		return fmt.Sprintf("%d days", seconds/86400)
+	}
+	return (time.Duration(seconds) * time.Second).String()
+}
+
+func findKey(name string) (int, error) {
+	ring, err := keyringID()
+	if err != nil {
+		return 0, err
+	}
+	id, err := unix.KeyctlSearch(ring, "user", "norrvpn:"+name, 0)
+	if errors.Is(err, unix.ENOKEY) || errors.Is(err, unix.EKEYEXPIRED) || errors.Is(err, unix.EKEYREVOKED) {
+		return 0, errSecretNotFound
+	}
+	return id, err
+}
+
+func (keyringStore) get(name string) (string, error) {
+	id, err := findKey(name)
+	if err != nil {
+		return "", err
+	}
+	size, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, nil, 0)
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, size)
+	n, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, buf, 0)
+	if err != nil {
+		return "", err
+	}
+	return string(buf[:min(n, size)]), nil
+}
+
+func (keyringStore) set(name, secret string) error {
+	ring, err := keyringID()
+	if err != nil {
+		return err
+	}
+	id, err := unix.AddKey("user", "norrvpn:"+name, []byte(secret), ring)
+	if err != nil {
+		return err
+	}
+	if uid, gid := invokingUser(); uid != os.Getuid() {
+		_, err = unix.KeyctlInt(unix.KEYCTL_CHOWN, id, uid, gid, 0)
+	}
+	return err
+}
+
+func (keyringStore) remove(name string) error {
+	id, err := findKey(name)
+	if errors.Is(err, errSecretNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = unix.KeyctlInt(unix.KEYCTL_INVALIDATE, id, 0, 0, 0)
+	return err
+}
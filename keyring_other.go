@@ -0,0 +1,28 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// keyringStore is unavailable outside Linux.
+type keyringStore struct{}
+
+func (keyringStore) name() string {
+	return "keyring"
+}
+
+func keyringLifetime() string {
+	return ""
+}
+
+func (keyringStore) get(string) (string, error) {
+	return "", errSecretNotFound
+}
+
+func (keyringStore) set(string, string) error {
+	return errors.New("the kernel keyring is only available on Linux")
+}
+
+func (keyringStore) remove(string) error {
+	return nil
+}
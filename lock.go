@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// lockPath is shared by all users, as the network state it protects is;
+// the token directory differs between root and sudo.
+const lockPath = "/run/norrvpn/norrvpn.lock"
+
+var waitFlag = flag.Bool("wait", false, "Wait for another norrvpn operation to finish instead of failing")
+
+// fileLock is an flock on lockPath. The holder writes its pid into the file
+// and clears it when done, so a pid found on acquiring belongs to an
+// operation that died halfway.
+type fileLock struct {
+	file *os.File
+}
+
+func acquireLock(wait bool) (*fileLock, error) {
+	if err := os.MkdirAll(filepath.Dir(lockPath), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		pid := lockHolder(file)
+		if !wait {
+			file.Close()
+			return nil, fmt.Errorf("another norrvpn operation is in progress (pid %d)", pid)
+		}
+		fmt.Fprintf(os.Stderr, "Waiting for another norrvpn operation (pid %d) to finish...\n", pid)
+		err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX)
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("locking %s: %w", lockPath, err)
+	}
+
+	if pid := lockHolder(file); pid != 0 && !processAlive(pid) {
+		slog.Warn("a previous norrvpn operation did not finish, run 'norrvpn repair' if the connection is broken",
+			"pid", pid)
+	}
+	lock := &fileLock{file: file}
+	if err := lock.setHolder(strconv.Itoa(os.Getpid()) + "\n"); err != nil {
+		lock.release()
+		return nil, err
+	}
+	return lock, nil
+}
+
+func (l *fileLock) release() {
+	l.setHolder("")
+	l.file.Close() // closing drops the flock
+}
+
+func (l *fileLock) setHolder(content string) error {
+	if err := l.file.Truncate(0); err != nil {
+		return err
+	}
+	_, err := l.file.WriteAt([]byte(content), 0)
+	return err
+}
+
+// lockHolder returns the pid written into the lock file, or 0.
+func lockHolder(file *os.File) int {
+	buf := make([]byte, 32)
+	n, _ := file.ReadAt(buf, 0)
+	pid, _ := strconv.Atoi(trim(string(buf[:n])))
+	return pid
+}
+
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
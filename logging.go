@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	logLevel  = flag.String("log-level", "", "Log level: debug, info, warn or error (default warn on the terminal, info otherwise)")
+	logFormat = flag.String("log-format", "", "Log format: text, json or journal (default journal under systemd, text otherwise)")
+	logFile   = flag.String("log-file", "", "Append logs to this file instead of standard error")
+)
+
+const journalSocket = "/run/systemd/journal/socket"
+
+// setupLogging installs the default slog logger according to the global
+// flags. Logs go to standard error, a file or the systemd journal.
+func setupLogging() error {
+	format := *logFormat
+	if format == "" {
+		format = "text"
+		// JOURNAL_STREAM is set by systemd when stderr is connected to the
+		// journal, i.e. when running as a service.
+		if os.Getenv("JOURNAL_STREAM") != "" && *logFile == "" {
+			format = "journal"
+		}
+	}
+
+	level := slog.LevelInfo
+	if *logLevel == "" && *logFile == "" && format != "journal" {
+		level = slog.LevelWarn
+	}
+	if *logLevel != "" {
+		if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+			return &usageError{msg: fmt.Sprintf("invalid --log-level %q", *logLevel)}
+		}
+	}
+
+	var out io.Writer = os.Stderr
+	if *logFile != "" {
+		file, err := os.OpenFile(*logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		out = file
+	}
+
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: redactAttr}
+	if out == os.Stderr && format == "text" {
+		// Timestamps are noise next to interactive output.
+		opts.ReplaceAttr = func(groups []string, attr slog.Attr) slog.Attr {
+			if len(groups) == 0 && attr.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return redactAttr(groups, attr)
+		}
+	}
+	var handler slog.Handler
+	switch format {
+	case "text":
+		handler = slog.NewTextHandler(out, opts)
+	case "json":
+		handler = slog.NewJSONHandler(out, opts)
+	case "journal":
+		if *logFile != "" {
+			return &usageError{msg: "--log-format journal cannot be combined with --log-file"}
+		}
+		var err error
+		handler, err = newJournalHandler(level)
+		if err != nil {
+			// Not fatal, stderr still ends up in the journal.
+			handler = slog.NewTextHandler(os.Stderr, opts)
+		}
+	default:
+		return &usageError{msg: fmt.Sprintf("invalid --log-format %q, expected text, json or journal", format)}
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// redactAttr masks secrets in string values and in the text of errors and
+// other values; those are only replaced by their text when it held one.
+func redactAttr(_ []string, attr slog.Attr) slog.Attr {
+	switch attr.Value.Kind() {
+	case slog.KindString:
+		attr.Value = slog.StringValue(redact(attr.Value.String()))
+	case slog.KindAny:
+		text := fmt.Sprint(attr.Value.Any())
+		if redacted := redact(text); redacted != text {
+			attr.Value = slog.StringValue(redacted)
+		}
+	}
+	return attr
+}
+
+// apiClient makes the requests to the NordVPN API, which are logged and
+// counted in the metrics. Webhooks and the IP check use http.DefaultClient.
+var apiClient = &http.Client{Transport: loggingTransport{http.DefaultTransport}}
+
+// loggingTransport logs every API request with its status and duration.
+// URLs carry no credentials; the token only travels in the auth header.
+type loggingTransport struct {
+	next http.RoundTripper
+}
+
+func (t loggingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	took := time.Since(start)
+	failure := err
+	if err == nil && resp.StatusCode >= 400 {
+		failure = errors.New(resp.Status)
+	}
+	metrics.observeRequest(req.URL.Path, took, failure)
+	if err != nil {
+		slog.Info("api request failed", "method", req.Method, "url", req.URL.String(), "took", took, "err", err)
+		return nil, err
+	}
+	slog.Debug("api request", "method", req.Method, "url", req.URL.String(), "status", resp.StatusCode, "took", took)
+	return resp, nil
+}
+
+// journalHandler writes entries to journald using its native protocol, so
+// that attributes become journal fields (see systemd.journal-fields(7)).
+type journalHandler struct {
+	conn   *net.UnixConn
+	level  slog.Leveler
+	attrs  []slog.Attr
+	prefix string
+}
+
+func newJournalHandler(level slog.Leveler) (*journalHandler, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &journalHandler{conn: conn, level: level}, nil
+}
+
+func (h *journalHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *journalHandler) Handle(_ context.Context, r slog.Record) error {
+	var b bytes.Buffer
+	writeJournalField(&b, "MESSAGE", redact(r.Message))
+	writeJournalField(&b, "PRIORITY", journalPriority(r.Level))
+	writeJournalField(&b, "SYSLOG_IDENTIFIER", "norrvpn")
+	for _, attr := range h.attrs {
+		writeJournalField(&b, journalFieldName(attr.Key), redact(attr.Value.String()))
+	}
+	r.Attrs(func(attr slog.Attr) bool {
+		writeJournalField(&b, journalFieldName(h.prefix+attr.Key), redact(attr.Value.String()))
+		return true
+	})
+	_, err := h.conn.Write(b.Bytes())
+	return err
+}
+
+func (h *journalHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	clone := *h
+	clone.attrs = append([]slog.Attr{}, h.attrs...)
+	for _, attr := range attrs {
+		attr.Key = h.prefix + attr.Key
+		clone.attrs = append(clone.attrs, attr)
+	}
+	return &clone
+}
+
+func (h *journalHandler) WithGroup(name string) slog.Handler {
+	clone := *h
+	clone.prefix = h.prefix + name + "_"
+	return &clone
+}
+
+func journalPriority(level slog.Level) string {
+	switch {
+	case level >= slog.LevelError:
+		return "3"
+	case level >= slog.LevelWarn:
+		return "4"
+	case level >= slog.LevelInfo:
+		return "6"
+	default:
+		return "7"
+	}
+}
+
+// journalFieldName maps an attribute key to a valid field name of upper case
+// letters, digits and underscores, prefixed to keep clear of trusted fields.
+func journalFieldName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, key)
+	return "NORRVPN_" + strings.TrimLeft(name, "_")
+}
+
+// writeJournalField uses the length-prefixed form for values containing
+// newlines, as the protocol requires.
+func writeJournalField(b *bytes.Buffer, name, value string) {
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(b, "%s=%s\n", name, value)
+		return
+	}
+	b.WriteString(name + "\n")
+	binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value + "\n")
+}
@@ -3,9 +3,16 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"log/slog"
 	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
 
 	"github.com/olekukonko/tablewriter"
 )
@@ -14,132 +21,470 @@ const defaultNordvpnAddress = "10.5.0.2/32"
 
 const interfaceName = "norrvpn01"
 
-var helpFlag = flag.Bool("help", false, "Show help information")
+var helpFlag = flag.Bool("help", false, "Show this help message")
+var showSecrets = flag.Bool("show-secrets", false, "Print tokens and private keys instead of masking them")
+var dryRunFlag = flag.Bool("dry-run", false, "Select the server and fetch credentials, but print the network changes instead of making them")
 
 const helpText = `Usage: norrvpn [flags] <command> [args]
 
 Commands:
-  up [cc] [city] Connect to VPN (optionally specify country code and city)
-  down           Disconnect from VPN
-  export         Export current connection as WireGuard config
-  init           Initialize with NordVPN token
-  showToken      Display stored token
-  listCountries  Show available country codes
+%s
 
 Flags:
-  --help         Show this help message
+%s
+
+Run 'norrvpn help <command>' to see the flags of a command.
 
 Examples:
-  norrvpn up gb london   Connect to server in London, Great Britain
-  norrvpn listCountries  Show all available country codes
-  norrvpn down           Disconnect current session`
+  norrvpn up gb london          Connect to server in London, Great Britain
+  norrvpn up us new york        City names may contain spaces
+  norrvpn up --group p2p de     Connect to a P2P server in Germany
+  norrvpn listCountries         Show all available country codes
+  norrvpn switch se             Move the connection to Sweden without dropping it
+  norrvpn down                  Disconnect current session`
+
+func init() {
+	commands = []*command{
+		newStatusCommand(),
+		newUpCommand(),
+		newPickCommand(),
+		newSwitchCommand(),
+		newDownCommand(),
+		newCheckCommand(),
+		newDoctorCommand(),
+		newRepairCommand(),
+		newExportCommand(),
+		newInitCommand(),
+		newLogoutCommand(),
+		newShowTokenCommand(),
+		newDaemonCommand(),
+		newWebhookCommand(),
+		newListCountriesCommand(),
+		newCompletionCommand(),
+		newHelpCommand(),
+		newCompleteCommand(),
+		newSecretServiceCommand(),
+	}
+}
 
 func main() {
+	flag.Usage = func() { fmt.Fprintln(os.Stderr, usage()) }
 	flag.Parse()
+	if err := setupLogging(); err != nil {
+		exitWithError(err)
+	}
 
 	if *helpFlag {
-		fmt.Println(helpText)
+		fmt.Println(usage())
 		os.Exit(0)
 	}
-	function := flag.Arg(0)
 
-	displayServerInfo := func(server Server) {
-		fmt.Printf("Server name: %s\n", server.Name)
-		fmt.Printf("Country: %s (%s)\n", server.Locations[0].Country.Name, server.Locations[0].Country.Code)
-		fmt.Printf("City: %s\n", server.Locations[0].Country.City.Name)
-		fmt.Printf("Load: %d%%\n", server.Load)
-		fmt.Printf("Status: %s\n", server.Status)
-		fmt.Printf("Hostname: %s\n", server.Hostname)
+	name := flag.Arg(0)
+	if name == "" {
+		name = "status"
+		if filepath.Base(os.Args[0]) == "norrvpnd" {
+			name = "daemon"
+		}
+	}
+	cmd := findCommand(name)
+	if cmd == nil {
+		exitWithError(&usageError{msg: fmt.Sprintf("unknown command %q", name)})
 	}
+	err := cmd.execute(flag.Args()[min(1, flag.NArg()):])
+	// Deliver what the command queued; anything failing is retried later.
+	if webhooksQueued.Load() {
+		flushWebhooks()
+	}
+	if err != nil {
+		exitWithError(err)
+	}
+}
+
+// output and errOutput receive what connect, disconnect, switchServer and
+// the hooks print. The daemon points them at the response of the request it
+// is handling; netMu guards them.
+var (
+	output    io.Writer = os.Stdout
+	errOutput io.Writer = os.Stderr
+)
+
+func displayServerInfo(server Server) {
+	fmt.Fprintf(output, "Server name: %s\n", server.Name)
+	fmt.Fprintf(output, "Country: %s (%s)\n", server.Locations[0].Country.Name, server.Locations[0].Country.Code)
+	fmt.Fprintf(output, "City: %s\n", server.Locations[0].Country.City.Name)
+	fmt.Fprintf(output, "Load: %d%%\n", server.Load)
+	fmt.Fprintf(output, "Status: %s\n", server.Status)
+	fmt.Fprintf(output, "Hostname: %s\n", server.Hostname)
+}
 
-	if function == "" {
-		if !isWGInterfaceExists(interfaceName) {
-			if _, err := os.Stat(serverInfoPath); err == nil {
-				os.Remove(serverInfoPath)
+func newStatusCommand() *command {
+	cmd := newCommand("status", "", "Show the current connection (default command)")
+	cmd.maxArgs = 0
+	follow := cmd.flags.Bool("follow", false, "Keep running and print events as JSON lines")
+	format := cmd.flags.String("format", "", "Go template applied to the status or each event, e.g. '{{.Country}} {{.Server}}'")
+	cmd.run = func([]string) error {
+		var tmpl *template.Template
+		if *format != "" {
+			var err error
+			if tmpl, err = template.New("format").Funcs(template.FuncMap{"bytes": humanBytes}).Parse(*format); err != nil {
+				return cmd.usagef("invalid --format: %v", err)
 			}
+		}
+		client := dialDaemon()
+		status := currentStatus()
+		if client != nil {
+			var err error
+			if status, err = client.status(); err != nil {
+				return err
+			}
+		}
+		if *follow {
+			return followEvents(client, status.event(), tmpl)
+		}
+		if tmpl != nil {
+			return printEvent(status.event(), tmpl)
+		}
+		if !status.Connected {
 			fmt.Printf("Not connected\n")
-			return
+			// Leftovers are kept for repair, which can restore the
+			// connection from them.
+			if state, err := inspectTunnel(); err == nil && state.leftover() {
+				fmt.Printf("A previous connection was not shut down cleanly, run 'sudo norrvpn repair'\n")
+			}
+			return nil
 		}
 
-		if server, err := loadServerInfo(); err == nil {
+		if status.Server != nil {
 			fmt.Printf("Currently connected to:\n")
-			displayServerInfo(server)
+			displayServerInfo(*status.Server)
 		} else {
 			fmt.Printf("Connected but server details not available\n")
 		}
-		return
+		return nil
 	}
+	return cmd
+}
 
-	switch function {
-	case "up":
-		if isWGInterfaceExists(interfaceName) {
-			fmt.Printf("Error: interface %s already exists. Please disconnect first.\n", interfaceName)
-			if server, err := loadServerInfo(); err == nil {
-				fmt.Printf("\nCurrently connected to:\n")
-				displayServerInfo(server)
+func newUpCommand() *command {
+	cmd := newCommand("up", "[cc] [city]", "Connect to VPN (optionally specify country code and city)")
+	var selection serverSelection
+	selection.register(cmd)
+	interactive := cmd.flags.Bool("interactive", false, "Choose country, city and server from a list")
+	rotate := cmd.flags.Duration("rotate", 0, "Stay in the foreground and move to another server at this interval, e.g. 30m")
+	maxLoad := cmd.flags.Int("max-load", 0, "Stay in the foreground and move to another server when the load stays above this percentage")
+	metricsFlag := registerMetricsFlag(cmd)
+	cmd.run = func(args []string) error {
+		cfg, err := loadConfig()
+		if err != nil {
+			return err
+		}
+		var opts watchOptions
+		if flagSet(cmd.flags, "rotate") {
+			opts.rotate = *rotate
+		} else if opts.rotate, err = configDuration("rotate", cfg.Rotate); err != nil {
+			return err
+		}
+		opts.maxLoad = cfg.MaxLoad
+		if flagSet(cmd.flags, "max-load") {
+			opts.maxLoad = *maxLoad
+		}
+		if opts.rotate < 0 {
+			return cmd.usagef("--rotate must not be negative")
+		}
+		if opts.maxLoad < 0 || opts.maxLoad > 100 {
+			return cmd.usagef("--max-load must be between 0 and 100")
+		}
+		opts.metrics = metricsAddress(cmd, *metricsFlag)
+		if flagSet(cmd.flags, "metrics") && !opts.enabled() {
+			return cmd.usagef("--metrics needs --rotate or --max-load")
+		}
+		client := dialDaemon()
+		if client == nil {
+			if err := checkDisconnected(); err != nil {
+				return err
 			}
-			os.Exit(1)
 		}
 
-		var host, key string
-		var server Server
-
-		if flag.NArg() == 1 {
-			host, key, server = FetchServerData(-1, -1)
-		} else if flag.NArg() == 2 {
-			countryID := getCountryCode(flag.Arg(1))
-			if countryID == -1 {
-				fmt.Printf("Error: Invalid country code '%s'\n", flag.Arg(1))
-				os.Exit(1)
+		var filter serverFilter
+		if *interactive {
+			if len(args) > 0 || selection != (serverSelection{}) {
+				return cmd.usagef("--interactive cannot be combined with a location")
 			}
-			host, key, server = FetchServerData(countryID, -1)
-		} else if flag.NArg() == 3 {
-			countryID := getCountryCode(flag.Arg(1))
-			if countryID == -1 {
-				fmt.Printf("Error: Invalid country code '%s'\n", flag.Arg(1))
-				os.Exit(1)
+			if opts.rotate > 0 {
+				return cmd.usagef("--interactive cannot be combined with --rotate")
 			}
-			cityID := getCityCode(countryID, flag.Arg(2))
-			if cityID == -1 {
-				fmt.Printf("Error: Invalid city name '%s' for country '%s'\n", flag.Arg(2), flag.Arg(1))
-				os.Exit(1)
+			filter, err = pickServer()
+		} else {
+			filter, err = selection.filter(cmd, args)
+		}
+		if err != nil {
+			return err
+		}
+		if opts.rotate > 0 && filter.Hostname != "" {
+			return cmd.usagef("--rotate needs a location, not a single server")
+		}
+		if client != nil {
+			return client.connect(filter, opts)
+		}
+		if err := connectReporting(filter); err != nil {
+			return err
+		}
+		if opts.enabled() && !*dryRunFlag {
+			return watch(filter, opts)
+		}
+		return nil
+	}
+	return cmd
+}
+
+func newPickCommand() *command {
+	cmd := newCommand("pick", "", "Choose a server interactively and connect to it")
+	cmd.maxArgs = 0
+	cmd.run = func([]string) error {
+		client := dialDaemon()
+		if client == nil {
+			if err := checkDisconnected(); err != nil {
+				return err
 			}
-			host, key, server = FetchServerData(countryID, cityID)
 		}
-		privateKey := fetchOwnPrivateKey(getToken())
+		filter, err := pickServer()
+		if err != nil {
+			return err
+		}
+		if client != nil {
+			return client.connect(filter, watchOptions{})
+		}
+		return connectReporting(filter)
+	}
+	return cmd
+}
 
-		fmt.Printf("Connecting to:\n")
+func checkDisconnected() error {
+	active := activeInterface()
+	if active == "" {
+		return nil
+	}
+	if server, err := loadServerInfo(); err == nil {
+		fmt.Printf("Currently connected to:\n")
 		displayServerInfo(server)
-		fmt.Printf("WG public key: %s\n", key)
-		fmt.Printf("WG private key: %s\n", privateKey)
-		if err := execWGup(interfaceName, privateKey, key, host, defaultNordvpnAddress); err != nil {
-			fmt.Printf("Error connecting: %v\n", err)
-			os.Exit(1)
+		fmt.Println()
+	}
+	return fmt.Errorf("interface %s already exists. Please disconnect first or use 'norrvpn switch'", active)
+}
+
+// connectReporting connects and emits a failed event when that does not
+// work.
+func connectReporting(filter serverFilter) error {
+	// Check again under the lock, another process may have connected since.
+	err := locked(func() error {
+		if err := checkDisconnected(); err != nil {
+			return err
 		}
+		return connect(filter)
+	})
+	if err != nil {
+		emitEvent(failureEvent("connect", err))
+	}
+	return err
+}
+
+// connect brings the tunnel up to the best server matching filter.
+func connect(filter serverFilter) error {
+	host, key, server := FetchServerData(filter)
+	privateKey, err := ownPrivateKey()
+	if err != nil {
+		return err
+	}
 
+	fmt.Fprintf(output, "Connecting to:\n")
+	displayServerInfo(server)
+	fmt.Fprintf(output, "WG public key: %s\n", key)
+	if *showSecrets {
+		fmt.Fprintf(output, "WG private key: %s\n", privateKey)
+	}
+	hooks := hookInfo{iface: interfaceName, server: server, endpoint: host, reason: "up"}
+	if err := runHooks(preUp, hooks); err != nil {
+		return err
+	}
+	start := time.Now()
+	emitEvent(serverEvent("connecting", interfaceName, server))
+	if err := execWGup(interfaceName, privateKey, key, host, defaultNordvpnAddress); err != nil {
+		return fmt.Errorf("connecting: %w", err)
+	}
+	if !*dryRunFlag {
+		slog.Info("connected", "interface", interfaceName, "server", server.Hostname, "endpoint", host, "took", time.Since(start))
+		emitEvent(serverEvent("connected", interfaceName, server))
 		saveServerInfo(server)
-	case "down":
-		if !isWGInterfaceExists(interfaceName) {
-			fmt.Printf("Error: interface %s does not exist\n", interfaceName)
-			os.Exit(1)
-		}
-
-		if server, err := loadServerInfo(); err == nil {
-			fmt.Printf("Disconnecting from %s (%s)...\n",
-				server.Locations[0].Country.Name,
-				server.Locations[0].Country.Code)
-		}
-		if err := execWGdown(interfaceName, defaultNordvpnAddress); err != nil {
-			fmt.Printf("Error disconnecting: %v\n", err)
-			os.Exit(1)
-		}
-		os.Remove(serverInfoPath)
-	case "init":
-		token := readSecretInput("Enter TOKEN")
-		setToken(token)
-	case "showToken":
-		fmt.Println(getToken())
-	case "listCountries":
+		saveServerFilter(filter)
+		recordServer(server.Hostname)
+	}
+	runHooks(postUp, hooks)
+	return nil
+}
+
+func newDownCommand() *command {
+	cmd := newCommand("down", "", "Disconnect from VPN")
+	cmd.maxArgs = 0
+	cmd.run = func([]string) error {
+		if client := dialDaemon(); client != nil {
+			return client.disconnect()
+		}
+		if err := locked(disconnect); err != nil {
+			emitEvent(failureEvent("disconnect", err))
+			return err
+		}
+		return nil
+	}
+	return cmd
+}
+
+func disconnect() error {
+	active := activeInterface()
+	if active == "" {
+		return fmt.Errorf("interface %s does not exist", interfaceName)
+	}
+
+	server, serverErr := loadServerInfo()
+	if serverErr == nil {
+		fmt.Fprintf(output, "Disconnecting from %s (%s)...\n",
+			server.Locations[0].Country.Name,
+			server.Locations[0].Country.Code)
+	}
+	hooks := hookInfo{iface: active, server: server, endpoint: interfaceEndpoint(active), reason: "down"}
+	if err := runHooks(preDown, hooks); err != nil {
+		return err
+	}
+	start := time.Now()
+	if err := execWGdown(active, defaultNordvpnAddress); err != nil {
+		return fmt.Errorf("disconnecting: %w", err)
+	}
+	if !*dryRunFlag {
+		slog.Info("disconnected", "interface", active, "took", time.Since(start))
+		emitEvent(serverEvent("disconnected", active, server))
+		forgetServer()
+	}
+	runHooks(postDown, hooks)
+	return nil
+}
+
+func newInitCommand() *command {
+	cmd := newCommand("init", "", "Initialize with NordVPN token (also read from $NORRVPN_TOKEN)")
+	cmd.maxArgs = 0
+	tokenFile := cmd.flags.String("token-file", "", "Read the token from this file")
+	tokenStdin := cmd.flags.Bool("token-stdin", false, "Read the token from standard input")
+	noVerify := cmd.flags.Bool("no-verify", false, "Store the token without checking it against the API")
+	storeName := cmd.flags.String("store", "file", "Where to keep the token: "+strings.Join(secretStoreNames(), ", "))
+	cmd.completeFlags["store"] = func(*completionContext) []string { return secretStoreNames() }
+	cmd.run = func([]string) error {
+		if *tokenFile != "" && *tokenStdin {
+			return cmd.usagef("--token-file and --token-stdin are mutually exclusive")
+		}
+		store := findSecretStore(*storeName)
+		if store == nil {
+			return cmd.usagef("unknown store %q, expected one of %s", *storeName, strings.Join(secretStoreNames(), ", "))
+		}
+
+		var token string
+		switch {
+		case *tokenFile != "":
+			data, err := os.ReadFile(*tokenFile)
+			if err != nil {
+				return err
+			}
+			token = trim(string(data))
+		case *tokenStdin:
+			data, err := io.ReadAll(os.Stdin)
+			if err != nil {
+				return err
+			}
+			token = trim(string(data))
+		case os.Getenv("NORRVPN_TOKEN") != "":
+			token = trim(os.Getenv("NORRVPN_TOKEN"))
+		default:
+			token = readSecretInput("Enter TOKEN")
+		}
+		if token == "" {
+			return fmt.Errorf("empty token")
+		}
+
+		// Verifying also fills the credentials cache, so that connecting
+		// works without the token from now on.
+		if !*noVerify {
+			if _, err := refreshCredentialsWith(token, store); err != nil {
+				return fmt.Errorf("token not saved: %w", err)
+			}
+		}
+		if err := setToken(store, token); err != nil {
+			return err
+		}
+		slog.Info("token saved", "store", store.name(), "verified", !*noVerify)
+		if store.name() == "file" {
+			fmt.Printf("Token saved to %s\n", tokenFullPath)
+		} else {
+			fmt.Printf("Token saved to the %s store\n", store.name())
+		}
+		// setToken removed the file copy, so nothing is left once the
+		// kernel drops the key.
+		if store.name() == "keyring" {
+			fmt.Fprintf(os.Stderr, "Warning: the kernel keyring is cleared on reboot and after %s without use. "+
+				"Run 'norrvpn init --store keyring' again then, or use --store file or secret-service.\n", keyringLifetime())
+		}
+		return nil
+	}
+	return cmd
+}
+
+func newLogoutCommand() *command {
+	cmd := newCommand("logout", "", "Remove the stored token and cached credentials")
+	cmd.maxArgs = 0
+	cmd.run = func([]string) error {
+		removed := false
+		var errs []error
+		for _, store := range secretStores {
+			_, err := store.get(tokenSecret)
+			if errors.Is(err, errSecretNotFound) {
+				continue
+			}
+			if err == nil {
+				err = store.remove(tokenSecret)
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", store.name(), err))
+				continue
+			}
+			fmt.Printf("Token removed from the %s store\n", store.name())
+			slog.Info("token removed", "store", store.name())
+			removed = true
+		}
+		if !removed && len(errs) == 0 {
+			fmt.Println("No token stored")
+		}
+		if err := removeCredentials(); err != nil {
+			errs = append(errs, fmt.Errorf("credentials cache: %w", err))
+		}
+		return errors.Join(errs...)
+	}
+	return cmd
+}
+
+func newShowTokenCommand() *command {
+	cmd := newCommand("showToken", "", "Display stored token, masked unless --show-secrets is given")
+	cmd.maxArgs = 0
+	cmd.run = func([]string) error {
+		token, store, err := lookupToken()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s (%s store)\n", maskSecret(token), store.name())
+		return nil
+	}
+	return cmd
+}
+
+func newListCountriesCommand() *command {
+	cmd := newCommand("listCountries", "", "Show available country codes")
+	cmd.maxArgs = 0
+	cmd.run = func([]string) error {
 		table := tablewriter.NewWriter(os.Stdout)
 		for _, country := range getCountryList() {
 			for _, city := range country.Cities {
@@ -155,35 +500,7 @@ func main() {
 		headers := []string{"Country", "Code", "Country ID", "City", "City ID"}
 		table.SetHeader(headers)
 		table.Render()
-	case "export":
-		if !isWGInterfaceExists(interfaceName) {
-			fmt.Println("Error: Not connected to VPN")
-			os.Exit(1)
-		}
-
-		server, err := loadServerInfo()
-		if err != nil {
-			fmt.Printf("Error loading server info: %v\n", err)
-			os.Exit(1)
-		}
-
-		var publicKey string
-		for _, tech := range server.Technologies {
-			if tech.Identifier == "wireguard_udp" {
-				publicKey = tech.Metadata[0].Value
-				break
-			}
-		}
-
-		privateKey := fetchOwnPrivateKey(getToken())
-
-		fmt.Printf("# wg config for %s (%s)\n", server.Name, server.Locations[0].Country.Code)
-		fmt.Printf("[Interface]\n")
-		fmt.Printf("Address = %s\n", defaultNordvpnAddress)
-		fmt.Printf("PrivateKey = %s\n\n", privateKey)
-		fmt.Printf("[Peer]\n")
-		fmt.Printf("PublicKey = %s\n", publicKey)
-		fmt.Printf("AllowedIPs = 0.0.0.0/0\n")
-		fmt.Printf("Endpoint = %s:%s\n", server.Hostname, defaultWGPort)
+		return nil
 	}
+	return cmd
 }
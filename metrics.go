@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metricsLoadInterval limits how often a scrape re-queries the server load.
+const metricsLoadInterval = time.Minute
+
+// metrics collects counters for the Prometheus endpoint.
+var metrics = &metricsRegistry{
+	events:      map[string]uint64{},
+	apiRequests: map[string]*apiStats{},
+}
+
+type apiStats struct {
+	count, errors uint64
+	seconds       float64
+}
+
+type metricsRegistry struct {
+	mu          sync.Mutex
+	events      map[string]uint64
+	apiRequests map[string]*apiStats
+
+	loadServer string
+	load       int
+	loadAt     time.Time
+}
+
+func (m *metricsRegistry) countEvent(kind string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.events[kind]++
+}
+
+// observeRequest records an API request by path, without the query.
+func (m *metricsRegistry) observeRequest(path string, took time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats := m.apiRequests[path]
+	if stats == nil {
+		stats = &apiStats{}
+		m.apiRequests[path] = stats
+	}
+	stats.count++
+	stats.seconds += took.Seconds()
+	if err != nil {
+		stats.errors++
+	}
+}
+
+// serverLoad returns the load of hostname, asking the API at most once per
+// metricsLoadInterval.
+func (m *metricsRegistry) serverLoad(hostname string) (int, bool) {
+	m.mu.Lock()
+	fresh := m.loadServer == hostname && time.Since(m.loadAt) < metricsLoadInterval
+	load := m.load
+	m.mu.Unlock()
+	if fresh {
+		return load, true
+	}
+	servers, err := fetchServerList(serverFilter{Hostname: hostname}, 1)
+	if err != nil || len(servers) == 0 {
+		return 0, false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.loadServer, m.load, m.loadAt = hostname, servers[0].Load, time.Now()
+	return m.load, true
+}
+
+// metricsWriter writes the Prometheus text exposition format.
+type metricsWriter struct {
+	b strings.Builder
+}
+
+func (w *metricsWriter) header(name, kind, help string) {
+	fmt.Fprintf(&w.b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func (w *metricsWriter) sample(name string, labels map[string]string, value float64) {
+	w.b.WriteString(name)
+	if len(labels) > 0 {
+		keys := make([]string, 0, len(labels))
+		for key := range labels {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		pairs := make([]string, len(keys))
+		for i, key := range keys {
+			pairs[i] = fmt.Sprintf("%s=%q", key, labels[key])
+		}
+		w.b.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+	fmt.Fprintf(&w.b, " %g\n", value)
+}
+
+func (m *metricsRegistry) render() string {
+	var w metricsWriter
+	status := currentStatus()
+	labels := map[string]string{}
+	if status.Server != nil {
+		labels["server"] = status.Server.Hostname
+		if len(status.Server.Locations) > 0 {
+			labels["country"] = status.Server.Locations[0].Country.Code
+			labels["city"] = status.Server.Locations[0].Country.City.Name
+		}
+	}
+
+	w.header("norrvpn_connected", "gauge", "Whether the tunnel is up.")
+	connected := 0.0
+	if status.Connected {
+		connected = 1
+	}
+	w.sample("norrvpn_connected", labels, connected)
+	if status.Connected {
+		if status.Server != nil {
+			if load, ok := m.serverLoad(status.Server.Hostname); ok {
+				w.header("norrvpn_server_load_percent", "gauge", "Load of the current server as reported by the API.")
+				w.sample("norrvpn_server_load_percent", labels, float64(load))
+			}
+		}
+		if status.Handshake != nil {
+			w.header("norrvpn_handshake_age_seconds", "gauge", "Time since the last WireGuard handshake.")
+			w.sample("norrvpn_handshake_age_seconds", labels, time.Since(*status.Handshake).Seconds())
+		}
+		w.header("norrvpn_receive_bytes_total", "counter", "Bytes received through the tunnel.")
+		w.sample("norrvpn_receive_bytes_total", labels, float64(status.RxBytes))
+		w.header("norrvpn_transmit_bytes_total", "counter", "Bytes sent through the tunnel.")
+		w.sample("norrvpn_transmit_bytes_total", labels, float64(status.TxBytes))
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w.header("norrvpn_reconnects_total", "counter", "Reconnects after the tunnel went stale.")
+	w.sample("norrvpn_reconnects_total", nil, float64(m.events["reconnecting"]))
+	w.header("norrvpn_server_changes_total", "counter", "Switches to another server.")
+	w.sample("norrvpn_server_changes_total", nil, float64(m.events["server-changed"]))
+	w.header("norrvpn_failures_total", "counter", "Failed connects, switches and reconnects.")
+	w.sample("norrvpn_failures_total", nil, float64(m.events["failed"]))
+
+	paths := make([]string, 0, len(m.apiRequests))
+	for path := range m.apiRequests {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	w.header("norrvpn_api_request_duration_seconds", "summary", "Duration of NordVPN API requests.")
+	for _, path := range paths {
+		stats := m.apiRequests[path]
+		w.sample("norrvpn_api_request_duration_seconds_sum", map[string]string{"path": path}, stats.seconds)
+		w.sample("norrvpn_api_request_duration_seconds_count", map[string]string{"path": path}, float64(stats.count))
+	}
+	w.header("norrvpn_api_request_errors_total", "counter", "NordVPN API requests that failed or were answered with an error status.")
+	for _, path := range paths {
+		w.sample("norrvpn_api_request_errors_total", map[string]string{"path": path}, float64(m.apiRequests[path].errors))
+	}
+	return w.b.String()
+}
+
+// registerMetricsFlag adds --metrics to cmd; config.json may set a default.
+func registerMetricsFlag(cmd *command) *string {
+	return cmd.flags.String("metrics", "", "Serve Prometheus metrics on this address, e.g. 127.0.0.1:9567 or unix:/run/norrvpn/metrics.sock")
+}
+
+// metricsAddress returns the flag value or the configured address.
+func metricsAddress(cmd *command, flagValue string) string {
+	if flagSet(cmd.flags, "metrics") {
+		return flagValue
+	}
+	cfg, _ := loadConfig()
+	return cfg.Metrics
+}
+
+// startMetrics serves /metrics on addr until ctx is done; an address of the
+// form unix:PATH listens on a Unix socket.
+func startMetrics(ctx context.Context, addr string) error {
+	if addr == "" {
+		return nil
+	}
+	var listener net.Listener
+	var err error
+	path, isUnix := strings.CutPrefix(addr, "unix:")
+	if isUnix {
+		os.Remove(path)
+		if listener, err = net.Listen("unix", path); err != nil {
+			return err
+		}
+		if err := restrictSocket(path); err != nil {
+			listener.Close()
+			return err
+		}
+	} else if listener, err = net.Listen("tcp", addr); err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		fmt.Fprint(w, metrics.render())
+	})
+	server := &http.Server{Handler: mux}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+		if isUnix {
+			os.Remove(path)
+		}
+	}()
+	go func() {
+		if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+			slog.Warn("metrics server failed", "err", err)
+		}
+	}()
+	slog.Info("serving metrics", "addr", addr)
+	return nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	monitorInterval = 5 * time.Second
+	// staleAfter is when WireGuard itself gives up on a session; with the
+	// keepalive a healthy tunnel rekeys every two minutes.
+	staleAfter = 3 * time.Minute
+	// reconnectInterval limits reconnect attempts while the tunnel is stale.
+	reconnectInterval = time.Minute
+)
+
+// tunnelSnapshot is the state of the tunnel at one poll.
+type tunnelSnapshot struct {
+	iface     string
+	server    Server
+	handshake time.Time
+	rx, tx    uint64
+}
+
+func readSnapshot() tunnelSnapshot {
+	snap := tunnelSnapshot{iface: activeInterface()}
+	if snap.iface == "" {
+		return snap
+	}
+	snap.server, _ = loadServerInfo()
+	// Both need CAP_NET_ADMIN; without it only the connection is known.
+	if out, err := exec.Command("wg", "show", snap.iface, "latest-handshakes").Output(); err == nil {
+		if fields := strings.Fields(string(out)); len(fields) == 2 {
+			if ts, err := strconv.ParseInt(fields[1], 10, 64); err == nil && ts > 0 {
+				snap.handshake = time.Unix(ts, 0)
+			}
+		}
+	}
+	if out, err := exec.Command("wg", "show", snap.iface, "transfer").Output(); err == nil {
+		if fields := strings.Fields(string(out)); len(fields) == 3 {
+			snap.rx, _ = strconv.ParseUint(fields[1], 10, 64)
+			snap.tx, _ = strconv.ParseUint(fields[2], 10, 64)
+		}
+	}
+	return snap
+}
+
+func (s tunnelSnapshot) fill(e *event) {
+	if !s.handshake.IsZero() {
+		handshake := s.handshake
+		e.Handshake = &handshake
+	}
+	e.RxBytes, e.TxBytes = s.rx, s.tx
+}
+
+// monitor turns successive snapshots into events.
+type monitor struct {
+	last  tunnelSnapshot
+	stale bool
+	// infer makes the monitor report connects and disconnects it sees, for
+	// when nothing else emits them.
+	infer bool
+}
+
+func (m *monitor) poll() []event {
+	snap := readSnapshot()
+	last := m.last
+	m.last = snap
+	var events []event
+	add := func(kind string) {
+		e := serverEvent(kind, snap.iface, snap.server)
+		snap.fill(&e)
+		events = append(events, e)
+	}
+
+	switch {
+	case snap.iface == "" && last.iface != "":
+		m.stale = false
+		if m.infer {
+			events = append(events, serverEvent("disconnected", last.iface, last.server))
+		}
+		return events
+	case snap.iface == "":
+		return nil
+	case last.iface == "":
+		if m.infer {
+			add("connected")
+		}
+	case snap.server.Hostname != last.server.Hostname:
+		if m.infer {
+			add("server-changed")
+		}
+	}
+
+	if !snap.handshake.IsZero() && !snap.handshake.Equal(last.handshake) {
+		add("handshake")
+	}
+	stale := !snap.handshake.IsZero() && time.Since(snap.handshake) > staleAfter
+	if stale && !m.stale {
+		add("stale")
+	}
+	m.stale = stale
+	if snap.rx != last.rx || snap.tx != last.tx {
+		add("traffic")
+	}
+	return events
+}
+
+// monitorLoop emits tunnel events until ctx is done. With reconnect set a
+// stale tunnel is moved to another server picked like the current one, see
+// locationFilter.
+func monitorLoop(ctx context.Context, reconnect bool) {
+	m := &monitor{last: readSnapshot()}
+	var lastReconnect time.Time
+	ticker := time.NewTicker(monitorInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, e := range m.poll() {
+			emitEvent(e)
+		}
+		if !reconnect || !m.stale || time.Since(lastReconnect) < reconnectInterval {
+			continue
+		}
+		lastReconnect = time.Now()
+		current := m.last.server
+		err := locked(func() error {
+			filter, err := locationFilter(loadServerFilter())
+			if err != nil {
+				return err
+			}
+			emitEvent(serverEvent("reconnecting", m.last.iface, current))
+			return switchServer(filter, nil, "reconnect")
+		})
+		if err != nil {
+			slog.Warn("reconnect failed", "server", current.Hostname, "err", err)
+			emitEvent(failureEvent("reconnect", err))
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/user"
+	"slices"
+	"strconv"
+)
+
+// notifyEvents are the events shown as desktop notifications.
+var notifyEvents = []string{"connected", "disconnected", "server-changed", "reconnecting", "stale", "failed"}
+
+// notifyDesktop shows e through org.freedesktop.Notifications when enabled
+// in config.json.
+func notifyDesktop(e event) {
+	if !slices.Contains(notifyEvents, e.Type) {
+		return
+	}
+	cfg, err := loadConfig()
+	if err != nil || !cfg.Notifications {
+		return
+	}
+
+	summary, body := notificationText(e)
+	urgency := "1"
+	if e.Type == "stale" || e.Type == "failed" {
+		urgency = "2"
+	}
+	for _, u := range notificationUsers() {
+		cmd := userCommandAs(u.uid, u.gid, "busctl", "--user", "--timeout=2", "call",
+			"org.freedesktop.Notifications", "/org/freedesktop/Notifications",
+			"org.freedesktop.Notifications", "Notify", "susssasa{sv}i",
+			"norrvpn", "0", "network-vpn", summary, body, "0", "1", "urgency", "y", urgency, "-1")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			slog.Debug("desktop notification failed", "uid", u.uid, "err", err, "output", trim(string(out)))
+		}
+	}
+}
+
+func notificationText(e event) (string, string) {
+	where := e.Server
+	if e.Country != "" {
+		where = fmt.Sprintf("%s, %s (%s)", e.Country, e.City, e.Server)
+	}
+	switch e.Type {
+	case "connected":
+		return "VPN connected", where
+	case "disconnected":
+		return "VPN disconnected", where
+	case "server-changed":
+		return "VPN server changed", where
+	case "reconnecting":
+		return "VPN reconnecting", "No handshake from " + e.Server + ", moving to another server"
+	case "stale":
+		return "VPN connection stale", "No handshake from " + e.Server + " for 3 minutes"
+	default:
+		return "VPN failure", e.Message
+	}
+}
+
+type sessionUser struct {
+	uid, gid int
+}
+
+// notificationUsers returns whose desktop to notify: the invoking user, or
+// for the daemon running as root every logged in member of the norrvpn group.
+func notificationUsers() []sessionUser {
+	uid, gid := invokingUser()
+	if uid != 0 {
+		return []sessionUser{{uid, gid}}
+	}
+	group, err := user.LookupGroup(daemonGroup)
+	if err != nil {
+		return nil
+	}
+	sessions, _ := os.ReadDir("/run/user")
+	var users []sessionUser
+	for _, session := range sessions {
+		if _, err := os.Stat("/run/user/" + session.Name() + "/bus"); err != nil {
+			continue
+		}
+		usr, err := user.LookupId(session.Name())
+		if err != nil {
+			continue
+		}
+		groups, err := usr.GroupIds()
+		if err != nil || !slices.Contains(groups, group.Gid) {
+			continue
+		}
+		uid, _ := strconv.Atoi(usr.Uid)
+		gid, _ := strconv.Atoi(usr.Gid)
+		users = append(users, sessionUser{uid, gid})
+	}
+	return users
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/term"
+)
+
+var (
+	errPickBack      = errors.New("back")
+	errPickCancelled = errors.New("selection cancelled")
+)
+
+// pickServer walks the user through country, city and server lists in raw
+// terminal mode and returns a filter for the chosen server.
+func pickServer() (serverFilter, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) || !term.IsTerminal(int(os.Stdout.Fd())) {
+		return serverFilter{}, errors.New("interactive selection requires a terminal")
+	}
+	countries := getCountryList()
+	sort.Slice(countries, func(i, j int) bool { return countries[i].Name < countries[j].Name })
+
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return serverFilter{}, err
+	}
+	// Alternate screen and hidden cursor, so the shell is left untouched.
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+	defer func() {
+		fmt.Print("\x1b[?25h\x1b[?1049l")
+		term.Restore(fd, state)
+	}()
+
+	var countryIdx, cityIdx int
+	stage := 0
+	for {
+		switch stage {
+		case 0:
+			labels := make([]string, len(countries))
+			for i, country := range countries {
+				labels[i] = fmt.Sprintf("%s (%s)", country.Name, strings.ToLower(country.Code))
+			}
+			countryIdx, err = pickFrom("Select a country", labels)
+			if errors.Is(err, errPickBack) {
+				return serverFilter{}, errPickCancelled
+			}
+		case 1:
+			country := countries[countryIdx]
+			labels := []string{"Any city"}
+			for _, city := range country.Cities {
+				labels = append(labels, city.Name)
+			}
+			cityIdx, err = pickFrom("Select a city in "+country.Name, labels)
+		case 2:
+			country := countries[countryIdx]
+			filter := serverFilter{CountryID: country.ID}
+			if cityIdx > 0 {
+				filter.CityID = country.Cities[cityIdx-1].ID
+			}
+			drawPicker("Loading servers...", "", nil, 0, 0)
+			servers, ferr := fetchServerList(filter, 50)
+			if ferr != nil {
+				return serverFilter{}, ferr
+			}
+			if len(servers) == 0 {
+				return serverFilter{}, fmt.Errorf("no servers found for the specified criteria")
+			}
+			labels := make([]string, len(servers))
+			for i, server := range servers {
+				city := ""
+				if len(server.Locations) > 0 {
+					city = server.Locations[0].Country.City.Name
+				}
+				labels[i] = fmt.Sprintf("%-24s %-20s load %3d%%", server.Hostname, city, server.Load)
+			}
+			var serverIdx int
+			serverIdx, err = pickFrom("Select a server", labels)
+			if err == nil {
+				return serverFilter{Hostname: servers[serverIdx].Hostname}, nil
+			}
+		}
+
+		switch {
+		case errors.Is(err, errPickBack):
+			stage--
+		case err != nil:
+			return serverFilter{}, err
+		default:
+			stage++
+		}
+	}
+}
+
+// pickFrom shows a filterable list and returns the index of the chosen item.
+// Typing filters, arrows move, Enter selects, Esc or Backspace on an empty
+// filter go back and Ctrl-C cancels.
+func pickFrom(title string, items []string) (int, error) {
+	query := ""
+	cursor, offset := 0, 0
+	buf := make([]byte, 16)
+	for {
+		var visible []int
+		for i, item := range items {
+			if strings.Contains(strings.ToLower(item), strings.ToLower(query)) {
+				visible = append(visible, i)
+			}
+		}
+		height := pickerHeight()
+		cursor = max(0, min(cursor, len(visible)-1))
+		if cursor < offset {
+			offset = cursor
+		}
+		if cursor >= offset+height {
+			offset = cursor - height + 1
+		}
+		drawPicker(title, query, labelsAt(items, visible), cursor, offset)
+
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			return -1, err
+		}
+		key := string(buf[:n])
+		switch key {
+		case "\x03":
+			return -1, errPickCancelled
+		case "\x1b":
+			return -1, errPickBack
+		case "\r", "\n":
+			if len(visible) > 0 {
+				return visible[cursor], nil
+			}
+		case "\x7f", "\x08":
+			if query == "" {
+				return -1, errPickBack
+			}
+			_, size := utf8.DecodeLastRuneInString(query)
+			query = query[:len(query)-size]
+			cursor = 0
+		case "\x1b[A", "\x1bOA", "\x10":
+			cursor--
+		case "\x1b[B", "\x1bOB", "\x0e":
+			cursor++
+		case "\x1b[5~":
+			cursor -= height
+		case "\x1b[6~":
+			cursor += height
+		case "\x1b[H", "\x1b[1~":
+			cursor = 0
+		case "\x1b[F", "\x1b[4~":
+			cursor = len(visible) - 1
+		default:
+			if buf[0] >= ' ' && buf[0] != 0x7f && utf8.ValidString(key) {
+				query += key
+				cursor = 0
+			}
+		}
+	}
+}
+
+func labelsAt(items []string, indices []int) []string {
+	labels := make([]string, len(indices))
+	for i, idx := range indices {
+		labels[i] = items[idx]
+	}
+	return labels
+}
+
+func pickerHeight() int {
+	_, rows, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil || rows <= 0 {
+		rows = 24
+	}
+	return max(rows-4, 1)
+}
+
+func drawPicker(title, query string, labels []string, cursor, offset int) {
+	width, _, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil || width <= 0 {
+		width = 80
+	}
+	fit := func(s string) string {
+		if utf8.RuneCountInString(s) > width {
+			return string([]rune(s)[:width])
+		}
+		return s
+	}
+
+	var b strings.Builder
+	b.WriteString("\x1b[H\x1b[2J")
+	b.WriteString(fit(title) + "\r\n")
+	if labels == nil {
+		fmt.Print(b.String())
+		return
+	}
+	b.WriteString(fit("> "+query) + "\r\n")
+	end := min(offset+pickerHeight(), len(labels))
+	for i := offset; i < end; i++ {
+		if i == cursor {
+			b.WriteString("\x1b[7m" + fit(labels[i]) + "\x1b[0m\r\n")
+		} else {
+			b.WriteString(fit(labels[i]) + "\r\n")
+		}
+	}
+	b.WriteString(fit(fmt.Sprintf("%d/%d  up/down move, enter select, esc back, ctrl-c quit",
+		min(cursor+1, len(labels)), len(labels))))
+	fmt.Print(b.String())
+}
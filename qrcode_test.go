@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestQRFormatBits(t *testing.T) {
+	// ISO/IEC 18004 Table C.1, after masking with 101010000010010.
+	want := map[qrLevel][8]int{
+		qrLevelL: {0x77C4, 0x72F3, 0x7DAA, 0x789D, 0x662F, 0x6318, 0x6C41, 0x6976},
+		qrLevelM: {0x5412, 0x5125, 0x5E7C, 0x5B4B, 0x45F9, 0x40CE, 0x4F97, 0x4AA0},
+	}
+	for level, bits := range want {
+		for mask, w := range bits {
+			if got := qrFormatBits(level, mask); got != w {
+				t.Errorf("qrFormatBits(%d, %d) = %#04x, want %#04x", level, mask, got, w)
+			}
+		}
+	}
+}
+
+func TestQRVersionBits(t *testing.T) {
+	// ISO/IEC 18004 Table D.1.
+	want := map[int]int{7: 0x07C94, 8: 0x085BC, 9: 0x09A99, 10: 0x0A4D3, 21: 0x15683, 40: 0x28C69}
+	for version, w := range want {
+		if got := qrVersionBits(version); got != w {
+			t.Errorf("qrVersionBits(%d) = %#05x, want %#05x", version, got, w)
+		}
+	}
+}
+
+func TestRSRemainder(t *testing.T) {
+	// ISO/IEC 18004 Annex I: "01234567" as version 1-M.
+	data := []byte{0x10, 0x20, 0x0C, 0x56, 0x61, 0x80, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11}
+	want := []byte{0xA5, 0x24, 0xD4, 0xC1, 0xED, 0x36, 0xC7, 0x87, 0x2C, 0x55}
+	if got := rsRemainder(data, rsDivisor(len(want))); !bytes.Equal(got, want) {
+		t.Errorf("rsRemainder = % X, want % X", got, want)
+	}
+}
+
+// wireGuardSample is long enough for version 8-M, which has blocks of two
+// sizes and version information.
+const wireGuardSample = `[Interface]
+PrivateKey = ...
+Address = 10.5.0.2/32
+DNS = 103.86.96.100
+[Peer]
+PublicKey = abcdefghijklmnop
+Endpoint = se1.nordvpn.com:51820`
+
+func TestEncodeQR(t *testing.T) {
+	// Matrices checked against an independent encoder, '#' is dark.
+	tests := []struct {
+		data  string
+		level qrLevel
+		want  []string
+	}{
+		{"norrvpn", qrLevelM, []string{ // version 1, mask 4
+			"#######.###...#######",
+			"#.....#..#.#..#.....#",
+			"#.###.#....##.#.###.#",
+			"#.###.#.#.#...#.###.#",
+			"#.###.#.###.#.#.###.#",
+			"#.....#.#.##..#.....#",
+			"#######.#.#.#.#######",
+			"........#####........",
+			"#...#.######.#####..#",
+			"..#.#..#..###....#.#.",
+			"##.####.####..###.##.",
+			"#.#.##..###..###....#",
+			"##.#.#####..######...",
+			"........#...###.#.##.",
+			"#######.#...##..####.",
+			"#.....#..#.##..##..##",
+			"#.###.#.####..#..#..#",
+			"#.###.#....##..##.###",
+			"#.###.#....#..#.###..",
+			"#.....#..##..###.....",
+			"#######.##..####.#..#",
+		}},
+		{wireGuardSample, qrLevelM, []string{ // version 8, mask 2
+			"#######..#..#.......#...#####.##........#.#######",
+			"#.....#....###..#.....###...##...###.####.#.....#",
+			"#.###.#.#.#.#...####.#..#####...#......##.#.###.#",
+			"#.###.#.#....#.#.#...#.#..#..###.#####.#..#.###.#",
+			"#.###.#.##.#..#...#########...###..##.....#.###.#",
+			"#.....#.#..###..##..###...#.#..#.##.###...#.....#",
+			"#######.#.#.#.#.#.#.#.#.#.#.#.#.#.#.#.#.#.#######",
+			"........#.#.#..###.####...#.#.####.####..........",
+			"#.#####...#.#.#..##.########.#....#####.#.#####..",
+			"##.##...####.#####.#..........#..#........##..##.",
+			"...#####.####..#...#...#...##....###.##.##.#....#",
+			"#.##...##..#...###..#...##.##..###.#.#..#.#.##..#",
+			".#.#.##..##.##.###.#.####.##..##.#####.##..#.#..#",
+			".#.##...##...####....#.....#####...###...##.##..#",
+			"#####.#####..##.####......#.#..#.##..##.#....#.##",
+			".......###.#....#.#..#.#.##....###.....###..##.#.",
+			".######.....#..#....#...#.##..#...#.#.###.....#..",
+			".###...#.###.####.##.#..##....##.....#.#..##.##..",
+			"....######..####.#.####.#.##.#.#.###..####.#....#",
+			"#.####..#..#.##..####......##.#.##...###.#.##...#",
+			"#.#..##...#...#...#.######....##...###.##.##.####",
+			".##.##...#.....##..#.##.#..#..#.#...#....###.#.##",
+			".##.######.##...#.##..#####.##.#..#.#...#####..##",
+			".#..#...##.###....##.##...#.##.###..#...#...##...",
+			"##..#.#.#.#...##.##.###.#.##.....#.######.#.#.#.#",
+			"##.##...#..#.#.#.##...#...###.##.#..#..##...###..",
+			"###.######..##...##########.##....#############.#",
+			"....##.#.#.#.#..##....####.##...##....#.#..#...##",
+			"##.####.#..#.#..#.#...###.##.###..####.#..#.#..#.",
+			"..###...#####..#.#.###..#.#######.......####..###",
+			"#..#..#.#...##.####.#.####..#...###.#.#...###..##",
+			".##.##.##.#.##.#...##...#..#..###.#..#.##....#.#.",
+			"#...######...##...#.#.#.###.#.....###..####.###..",
+			".##.#...#..###.#..##....#.###.#.#...##.....#..##.",
+			"..#.#.#....#.#...#...##.#...##..###.########.####",
+			"##.#....##..###.#....#..######..#.....#....#.....",
+			"..#####...####.##...####.##..###.#..#.##..###.##.",
+			"#....#..#.####.#.###.##.###.#.##...###..#.#..#.#.",
+			".#...#####.###...##...####.##..#.###.#....#.##.##",
+			".###...#.....##..##...#.#####..##.#.#...#..###.##",
+			"###...#.######.#...#########..#....##.###########",
+			"........#..###.###.#..#...###.#..#......#...##.#.",
+			"#######..#..#.....###.#.#.#..#...##....##.#.##..#",
+			"#.....#.#..##.##.##..##...###......#...##...#...#",
+			"#.###.#.##..#...#..#..######...#.#.##..######.#.#",
+			"#.###.#.#####............###.###....#..##...##..#",
+			"#.###.#.###..#...#.#...##.##...#.##.###..###.#...",
+			"#.....#..#.#.#...##..#.#####..###.##.#.####.....#",
+			"#######.##..#.##.####...#..#..#....##.#.#..#..###",
+		}},
+	}
+	for _, test := range tests {
+		qr, err := encodeQR([]byte(test.data), test.level)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, row := range qr.modules {
+			var line strings.Builder
+			for _, dark := range row {
+				if dark {
+					line.WriteByte('#')
+				} else {
+					line.WriteByte('.')
+				}
+			}
+			got = append(got, line.String())
+		}
+		if g, w := strings.Join(got, "\n"), strings.Join(test.want, "\n"); g != w {
+			t.Errorf("encodeQR(%q) =\n%s\nwant\n%s", test.data, g, w)
+		}
+	}
+}
+
+func TestEncodeQRTooLong(t *testing.T) {
+	// Version 40-L holds 2953 bytes.
+	if _, err := encodeQR(make([]byte, 2954), qrLevelL); err != errQRTooLong {
+		t.Errorf("encodeQR of 2954 bytes: err = %v, want errQRTooLong", err)
+	}
+}
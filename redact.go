@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strings"
+	"sync"
+)
+
+// Secrets seen during this run. Anything printed on failure paths goes
+// through redact, so that tokens and private keys never end up in a
+// terminal scrollback or a log unless --show-secrets is given.
+var (
+	secretsMu sync.Mutex
+	secrets   []string
+)
+
+const redacted = "<redacted>"
+
+func registerSecret(secret string) {
+	if secret == "" {
+		return
+	}
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	for _, known := range secrets {
+		if known == secret {
+			return
+		}
+	}
+	secrets = append(secrets, secret)
+}
+
+// redact replaces every registered secret in s.
+func redact(s string) string {
+	if *showSecrets {
+		return s
+	}
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	for _, secret := range secrets {
+		s = strings.ReplaceAll(s, secret, redacted)
+	}
+	return s
+}
+
+// maskSecret shows just enough of a secret to recognise it.
+func maskSecret(secret string) string {
+	if *showSecrets {
+		return secret
+	}
+	if len(secret) <= 8 {
+		return strings.Repeat("*", len(secret))
+	}
+	return secret[:4] + strings.Repeat("*", 12)
+}
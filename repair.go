@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Rules norrvpn adds, as printed by `ip rule show`.
+var (
+	endpointRuleRe = regexp.MustCompile(`^219:\s+from all to (\S+) lookup main$`)
+	tunnelRuleRe   = regexp.MustCompile(`^220:\s+from all lookup (212450|212451)$`)
+)
+
+// tunnelState is what is actually configured for norrvpn, next to what
+// current_server.json records.
+type tunnelState struct {
+	links     []string          // tunnel interfaces that exist
+	endpoints map[string]string // peer endpoint IP of each link that has one
+	peers     map[string]string // peer public key of each link that has one
+	routes    map[string]bool   // links with the default route in their table
+	// endpointRules and tunnelRules hold the destinations of the priority
+	// 219 rules and the tables of the priority 220 rules, in rule order.
+	endpointRules []string
+	tunnelRules   []string
+	server        Server
+	recorded      bool
+}
+
+func inspectTunnel() (tunnelState, error) {
+	state := tunnelState{endpoints: map[string]string{}, peers: map[string]string{}, routes: map[string]bool{}}
+	for _, name := range tunnelInterfaces {
+		if !isWGInterfaceExists(name) {
+			continue
+		}
+		state.links = append(state.links, name)
+		if endpoint := wgEndpoint(name); endpoint != "" {
+			state.endpoints[name] = endpoint
+		}
+		if out, err := exec.Command("wg", "show", name, "peers").Output(); err == nil {
+			if peers := strings.Fields(string(out)); len(peers) > 0 {
+				state.peers[name] = peers[0]
+			}
+		}
+		out, err := exec.Command("ip", "route", "show", "table", routingTable(name)).Output()
+		if err == nil && strings.Contains(string(out), "default dev "+name) {
+			state.routes[name] = true
+		}
+	}
+
+	out, err := exec.Command("ip", "rule", "show").Output()
+	if err != nil {
+		return state, fmt.Errorf("ip rule show: %w", err)
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if m := endpointRuleRe.FindStringSubmatch(trim(line)); m != nil {
+			state.endpointRules = append(state.endpointRules, m[1])
+		}
+		if m := tunnelRuleRe.FindStringSubmatch(trim(line)); m != nil {
+			state.tunnelRules = append(state.tunnelRules, m[1])
+		}
+	}
+
+	server, err := loadServerInfo()
+	state.server, state.recorded = server, err == nil
+	return state, nil
+}
+
+// leftover reports whether anything of a connection remains although no
+// tunnel interface exists.
+func (s tunnelState) leftover() bool {
+	return len(s.links) == 0 && (s.recorded || len(s.endpointRules) > 0 || len(s.tunnelRules) > 0)
+}
+
+// matchesRecord reports whether the peer of link is the recorded server, by
+// its public key or else its station IP. Without a record, or with nothing
+// to compare, the link is taken to match.
+func (s tunnelState) matchesRecord(link string) bool {
+	if !s.recorded {
+		return true
+	}
+	if key := serverPublicKey(s.server); key != "" && s.peers[link] != "" {
+		return s.peers[link] == key
+	}
+	if s.server.Station != "" {
+		return s.endpoints[link] == s.server.Station
+	}
+	return true
+}
+
+// repairAction is one step of a repair, described as the command it runs
+// where there is one.
+type repairAction struct {
+	desc string
+	do   func() error
+}
+
+func opAction(o netOp) repairAction {
+	return repairAction{desc: o.String(), do: o.exec}
+}
+
+// planRepair lists what brings the network in line with a single working
+// tunnel, or with none when disconnect is set or no tunnel is usable.
+// A usable tunnel is kept and its route and rules are restored; everything
+// else of norrvpn is removed. A tunnel to another server than the recorded
+// one is not usable, as hooks, status and events would all describe the
+// wrong server. Without a usable tunnel the recorded server is connected to
+// again.
+//
+// norrvpn does not change DNS or firewall settings itself. Hooks that do
+// are run when repair ends a connection (post-down) or restores one
+// (pre-up and post-up), so that they can bring those in line as well.
+func planRepair(state tunnelState, disconnect bool) []repairAction {
+	keep := ""
+	if !disconnect {
+		for _, name := range state.links {
+			if state.endpoints[name] == "" || !state.matchesRecord(name) {
+				continue
+			}
+			if keep == "" || slices.Contains(state.tunnelRules, routingTable(name)) {
+				keep = name
+			}
+		}
+	}
+
+	var actions []repairAction
+	for _, name := range state.links {
+		if name != keep {
+			actions = append(actions, opAction(newNetOp("ip", "link", "delete", "dev", name)))
+		}
+	}
+
+	keptEndpoint, keptTable := "", ""
+	if keep != "" {
+		keptEndpoint, keptTable = state.endpoints[keep], routingTable(keep)
+		if !state.routes[keep] {
+			actions = append(actions, opAction(newNetOp("ip", "route", "add", "default", "dev", keep, "table", keptTable)))
+		}
+	}
+	// Keep the first matching rule of each priority and delete the rest.
+	found := false
+	for _, destination := range state.endpointRules {
+		if destination == keptEndpoint && !found {
+			found = true
+			continue
+		}
+		actions = append(actions, opAction(endpointRule("delete", destination)))
+	}
+	if keep != "" && !found {
+		actions = append(actions, opAction(endpointRule("add", keptEndpoint)))
+	}
+	found = false
+	for _, table := range state.tunnelRules {
+		if table == keptTable && !found {
+			found = true
+			continue
+		}
+		actions = append(actions, opAction(tunnelRule("delete", table)))
+	}
+	if keep != "" && !found {
+		actions = append(actions, opAction(tunnelRule("add", keptTable)))
+	}
+
+	if keep != "" || !state.recorded {
+		return actions
+	}
+	server := state.server
+	if !disconnect {
+		return append(actions, repairAction{
+			desc: "connect to " + server.Hostname + " again",
+			do:   func() error { return connect(serverFilter{Hostname: server.Hostname}) },
+		})
+	}
+	iface := interfaceName
+	if len(state.links) > 0 {
+		iface = state.links[0]
+	}
+	return append(actions, repairAction{
+		desc: "forget " + server.Hostname + " and run the post-down hooks",
+		do: func() error {
+			emitEvent(serverEvent("disconnected", iface, server))
+			forgetServer()
+			runHooks(postDown, hookInfo{iface: iface, server: server, reason: "repair"})
+			return nil
+		},
+	})
+}
+
+// repair inspects the tunnel and applies the plan; with dryRun set it only
+// returns the plan.
+func repair(dryRun, disconnect bool) ([]string, error) {
+	// Without CAP_NET_ADMIN wg cannot read the peers, and every tunnel
+	// would look broken.
+	if os.Geteuid() != 0 && !hasCapability(capNetAdmin) {
+		return nil, fmt.Errorf("repair needs root, run it with sudo")
+	}
+	state, err := inspectTunnel()
+	if err != nil {
+		return nil, err
+	}
+	actions := planRepair(state, disconnect)
+	var done []string
+	for _, action := range actions {
+		if !dryRun {
+			if err := action.do(); err != nil {
+				return done, err
+			}
+		}
+		done = append(done, action.desc)
+	}
+	return done, nil
+}
+
+func newRepairCommand() *command {
+	cmd := newCommand("repair", "", "Bring interfaces, routes and rules in line with the recorded connection")
+	cmd.maxArgs = 0
+	dryRun := cmd.flags.Bool("dry-run", false, "Only list what would be done, like the global --dry-run")
+	disconnectFlag := cmd.flags.Bool("disconnect", false, "Remove everything instead of restoring the connection")
+	cmd.run = func([]string) error {
+		*dryRun = *dryRun || *dryRunFlag
+		var actions []string
+		var err error
+		if client := dialDaemon(); client != nil {
+			actions, err = client.repair(*dryRun, *disconnectFlag)
+		} else {
+			err = locked(func() error {
+				actions, err = repair(*dryRun, *disconnectFlag)
+				return err
+			})
+			if err != nil {
+				emitEvent(failureEvent("repair", err))
+			}
+		}
+		if len(actions) == 0 && err == nil {
+			fmt.Println("Nothing to repair")
+			return nil
+		}
+		if *dryRun {
+			fmt.Println("Would run:")
+		}
+		for _, action := range actions {
+			fmt.Printf("  %s\n", action)
+		}
+		return err
+	}
+	return cmd
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// secretServiceStore keeps secrets in the freedesktop Secret Service (GNOME
+// Keyring, KWallet) over D-Bus, found by the attributes application=norrvpn
+// and type=<name>. Only the invoking user can reach
+// their session bus, so under sudo norrvpn runs itself as them for this,
+// see newSecretServiceCommand.
+type secretServiceStore struct{}
+
+func secretServiceAttributes(name string) map[string]string {
+	return map[string]string{"application": "norrvpn", "type": name}
+}
+
+var secretServiceLabels = map[string]string{
+	tokenSecret:          "NordVPN token (norrvpn)",
+	credentialsKeySecret: "NordVPN credentials cache key (norrvpn)",
+}
+
+const (
+	secretServiceName   = "org.freedesktop.secrets"
+	secretServicePath   = "/org/freedesktop/secrets"
+	secretIface         = "org.freedesktop.Secret."
+	secretPromptTimeout = 2 * time.Minute
+)
+
+// errNoSecretService means there is no session bus or no Secret Service on
+// it, as on headless machines; nothing can be stored there then.
+var errNoSecretService = errors.New("no Secret Service on the session bus")
+
+func (secretServiceStore) name() string {
+	return "secret-service"
+}
+
+func (secretServiceStore) get(name string) (string, error) {
+	if !underSudo() {
+		return secretServiceGet(name)
+	}
+	secret, err := secretServiceHelper("", "get", name)
+	if err == nil && secret == "" {
+		return "", errSecretNotFound
+	}
+	return secret, err
+}
+
+func (secretServiceStore) set(name, secret string) error {
+	if !underSudo() {
+		return secretServiceSet(name, secret)
+	}
+	_, err := secretServiceHelper(secret, "set", name)
+	return err
+}
+
+func (secretServiceStore) remove(name string) error {
+	if !underSudo() {
+		return secretServiceRemove(name)
+	}
+	_, err := secretServiceHelper("", "remove", name)
+	return err
+}
+
+// underSudo reports whether norrvpn runs on behalf of another user.
+func underSudo() bool {
+	uid, _ := invokingUser()
+	return uid != os.Geteuid()
+}
+
+// secretServiceHelper runs the __secret-service command as the invoking
+// user and returns what it printed.
+func secretServiceHelper(input string, args ...string) (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	cmd := userCommand(exe, append([]string{"__secret-service"}, args...)...)
+	cmd.Stdin = strings.NewReader(input)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", err, trim(stderr.String()))
+	}
+	return trim(string(out)), nil
+}
+
+// newSecretServiceCommand is the hidden command behind secretServiceHelper.
+// It reads the secret to store from standard input and prints the one it
+// finds, or nothing.
+func newSecretServiceCommand() *command {
+	cmd := newCommand("__secret-service", "get|set|remove name", "Access the Secret Service as the current user")
+	cmd.hidden = true
+	cmd.minArgs, cmd.maxArgs = 2, 2
+	cmd.run = func(args []string) error {
+		name := args[1]
+		if _, ok := secretServiceLabels[name]; !ok {
+			return cmd.usagef("unknown secret %q", name)
+		}
+		switch args[0] {
+		case "get":
+			secret, err := secretServiceGet(name)
+			if errors.Is(err, errSecretNotFound) {
+				return nil
+			}
+			if err == nil {
+				fmt.Println(secret)
+			}
+			return err
+		case "set":
+			data, err := io.ReadAll(os.Stdin)
+			if err != nil {
+				return err
+			}
+			return secretServiceSet(name, trim(string(data)))
+		case "remove":
+			return secretServiceRemove(name)
+		}
+		return cmd.usagef("unknown operation %q", args[0])
+	}
+	return cmd
+}
+
+func secretServiceGet(name string) (string, error) {
+	s, err := openSecretService()
+	if err != nil {
+		if errors.Is(err, errNoSecretService) {
+			return "", errSecretNotFound
+		}
+		return "", err
+	}
+	defer s.close()
+	items, err := s.search(name)
+	if err != nil {
+		return "", err
+	}
+	if len(items) == 0 {
+		return "", errSecretNotFound
+	}
+	var secret secretServiceSecret
+	err = s.conn.Object(secretServiceName, items[0]).Call(secretIface+"Item.GetSecret", 0, s.session).Store(&secret)
+	if err != nil {
+		return "", fmt.Errorf("reading %s: %w", name, err)
+	}
+	return string(secret.Value), nil
+}
+
+func secretServiceSet(name, secret string) error {
+	s, err := openSecretService()
+	if err != nil {
+		return err
+	}
+	defer s.close()
+	var collection dbus.ObjectPath
+	if err := s.service().Call(secretIface+"Service.ReadAlias", 0, "default").Store(&collection); err != nil {
+		return err
+	}
+	if collection == "/" {
+		return errors.New("the Secret Service has no default collection")
+	}
+	locked, err := s.conn.Object(secretServiceName, collection).GetProperty(secretIface + "Collection.Locked")
+	if err != nil {
+		return err
+	}
+	if locked, _ := locked.Value().(bool); locked {
+		if err := s.unlock([]dbus.ObjectPath{collection}); err != nil {
+			return err
+		}
+	}
+
+	properties := map[string]dbus.Variant{
+		secretIface + "Item.Label":      dbus.MakeVariant(secretServiceLabels[name]),
+		secretIface + "Item.Attributes": dbus.MakeVariant(secretServiceAttributes(name)),
+	}
+	value := secretServiceSecret{Session: s.session, Value: []byte(secret), ContentType: "text/plain"}
+	var item, prompt dbus.ObjectPath
+	err = s.conn.Object(secretServiceName, collection).Call(secretIface+"Collection.CreateItem", 0, properties, value, true).
+		Store(&item, &prompt)
+	if err != nil {
+		return fmt.Errorf("storing %s: %w", name, err)
+	}
+	return s.prompt(prompt)
+}
+
+func secretServiceRemove(name string) error {
+	s, err := openSecretService()
+	if err != nil {
+		if errors.Is(err, errNoSecretService) {
+			return nil
+		}
+		return err
+	}
+	defer s.close()
+	items, err := s.search(name)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		var prompt dbus.ObjectPath
+		if err := s.conn.Object(secretServiceName, item).Call(secretIface+"Item.Delete", 0).Store(&prompt); err != nil {
+			return fmt.Errorf("removing %s: %w", name, err)
+		}
+		if err := s.prompt(prompt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// secretServiceSecret is the Secret struct of the Secret Service API. With
+// the plain algorithm the value is not encrypted; it only travels over the
+// user's session bus.
+type secretServiceSecret struct {
+	Session     dbus.ObjectPath
+	Parameters  []byte
+	Value       []byte
+	ContentType string
+}
+
+// secretService is a session on the Secret Service of the current user.
+type secretService struct {
+	conn    *dbus.Conn
+	session dbus.ObjectPath
+}
+
+func openSecretService() (*secretService, error) {
+	conn, err := dbus.ConnectSessionBus()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errNoSecretService, err)
+	}
+	s := &secretService{conn: conn}
+	var output dbus.Variant
+	err = s.service().Call(secretIface+"Service.OpenSession", 0, "plain", dbus.MakeVariant("")).Store(&output, &s.session)
+	var dbusErr dbus.Error
+	if errors.As(err, &dbusErr) && dbusErr.Name == "org.freedesktop.DBus.Error.ServiceUnknown" {
+		err = errNoSecretService
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("opening a Secret Service session: %w", err)
+	}
+	return s, nil
+}
+
+func (s *secretService) close() {
+	s.conn.Object(secretServiceName, s.session).Call(secretIface+"Session.Close", 0)
+	s.conn.Close()
+}
+
+func (s *secretService) service() dbus.BusObject {
+	return s.conn.Object(secretServiceName, secretServicePath)
+}
+
+// search returns the items holding the named secret, unlocking locked ones.
+func (s *secretService) search(name string) ([]dbus.ObjectPath, error) {
+	var unlocked, locked []dbus.ObjectPath
+	err := s.service().Call(secretIface+"Service.SearchItems", 0, secretServiceAttributes(name)).Store(&unlocked, &locked)
+	if err != nil {
+		return nil, fmt.Errorf("searching %s: %w", name, err)
+	}
+	if len(locked) > 0 {
+		if err := s.unlock(locked); err != nil {
+			return nil, err
+		}
+	}
+	return append(unlocked, locked...), nil
+}
+
+func (s *secretService) unlock(objects []dbus.ObjectPath) error {
+	var unlocked []dbus.ObjectPath
+	var prompt dbus.ObjectPath
+	if err := s.service().Call(secretIface+"Service.Unlock", 0, objects).Store(&unlocked, &prompt); err != nil {
+		return fmt.Errorf("unlocking the keyring: %w", err)
+	}
+	return s.prompt(prompt)
+}
+
+// prompt lets the service ask the user, e.g. for the password of a locked
+// collection, and waits for the answer. "/" means no prompt is needed.
+func (s *secretService) prompt(path dbus.ObjectPath) error {
+	if path == "/" || path == "" {
+		return nil
+	}
+	err := s.conn.AddMatchSignal(dbus.WithMatchObjectPath(path), dbus.WithMatchInterface(secretIface+"Prompt"),
+		dbus.WithMatchMember("Completed"))
+	if err != nil {
+		return err
+	}
+	signals := make(chan *dbus.Signal, 1)
+	s.conn.Signal(signals)
+	defer s.conn.RemoveSignal(signals)
+	if err := s.conn.Object(secretServiceName, path).Call(secretIface+"Prompt.Prompt", 0, "").Err; err != nil {
+		return err
+	}
+	timeout := time.After(secretPromptTimeout)
+	for {
+		select {
+		case signal := <-signals:
+			if signal.Path != path || len(signal.Body) == 0 {
+				continue
+			}
+			if dismissed, _ := signal.Body[0].(bool); dismissed {
+				return errors.New("the keyring prompt was dismissed")
+			}
+			return nil
+		case <-timeout:
+			return errors.New("no answer to the keyring prompt")
+		}
+	}
+}
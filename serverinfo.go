@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"os"
+	"time"
 )
 
 var serverInfoPath = tokenPath + "/current_server.json"
@@ -23,3 +24,69 @@ func loadServerInfo() (Server, error) {
 	err = json.Unmarshal(data, &server)
 	return server, err
 }
+
+// serverFilterPath records the filter the current server was picked with,
+// so that a replacement can be looked for under the same criteria.
+var serverFilterPath = tokenPath + "/current_filter.json"
+
+func saveServerFilter(filter serverFilter) {
+	data, err := json.Marshal(filter)
+	if err != nil || os.MkdirAll(tokenPath, 0700) != nil {
+		return
+	}
+	os.WriteFile(serverFilterPath, data, 0600)
+}
+
+// loadServerFilter returns the recorded filter, or the empty one.
+func loadServerFilter() serverFilter {
+	var filter serverFilter
+	if data, err := os.ReadFile(serverFilterPath); err == nil {
+		json.Unmarshal(data, &filter)
+	}
+	return filter
+}
+
+// forgetServer removes the record of the current server.
+func forgetServer() {
+	os.Remove(serverInfoPath)
+	os.Remove(serverFilterPath)
+}
+
+var historyPath = tokenPath + "/history.json"
+
+// historySize is how many recently used servers rotation avoids.
+const historySize = 10
+
+type historyEntry struct {
+	Hostname string    `json:"hostname"`
+	UsedAt   time.Time `json:"used_at"`
+}
+
+// recordServer appends hostname to the list of recently used servers.
+func recordServer(hostname string) {
+	history := append(loadHistory(), historyEntry{Hostname: hostname, UsedAt: time.Now()})
+	if len(history) > historySize {
+		history = history[len(history)-historySize:]
+	}
+	data, err := json.Marshal(history)
+	if err != nil || os.MkdirAll(tokenPath, 0700) != nil {
+		return
+	}
+	os.WriteFile(historyPath, data, 0600)
+}
+
+func loadHistory() []historyEntry {
+	var history []historyEntry
+	if data, err := os.ReadFile(historyPath); err == nil {
+		json.Unmarshal(data, &history)
+	}
+	return history
+}
+
+func recentServers() []string {
+	var hostnames []string
+	for _, entry := range loadHistory() {
+		hostnames = append(hostnames, entry.Hostname)
+	}
+	return hostnames
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// invokingUser returns the uid and gid of the user behind sudo, or of the
+// current process when not running under sudo.
+func invokingUser() (uid, gid int) {
+	uid, gid = os.Getuid(), os.Getgid()
+	if v, err := strconv.Atoi(os.Getenv("SUDO_UID")); err == nil {
+		uid = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("SUDO_GID")); err == nil {
+		gid = v
+	}
+	return uid, gid
+}
+
+// userCommand prepares a command that runs as the invoking user inside their
+// desktop session, so that it reaches their session bus even under sudo.
+func userCommand(name string, args ...string) *exec.Cmd {
+	uid, gid := invokingUser()
+	return userCommandAs(uid, gid, name, args...)
+}
+
+// userCommandAs is userCommand for a given user.
+func userCommandAs(uid, gid int, name string, args ...string) *exec.Cmd {
+	cmd := exec.Command(name, args...)
+	env := os.Environ()
+	if os.Getenv("DBUS_SESSION_BUS_ADDRESS") == "" {
+		env = append(env, fmt.Sprintf("DBUS_SESSION_BUS_ADDRESS=unix:path=/run/user/%d/bus", uid))
+	}
+	if uid != os.Getuid() {
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Credential: &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)},
+		}
+		env = append(env, fmt.Sprintf("XDG_RUNTIME_DIR=/run/user/%d", uid))
+		if usr, err := user.LookupId(strconv.Itoa(uid)); err == nil {
+			env = append(env, "HOME="+usr.HomeDir, "USER="+usr.Username, "LOGNAME="+usr.Username)
+		}
+	}
+	cmd.Env = env
+	return cmd
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+const handshakeTimeout = 10 * time.Second
+
+func newSwitchCommand() *command {
+	cmd := newCommand("switch", "[cc] [city]", "Move the connection to another server without disconnecting")
+	var selection serverSelection
+	selection.register(cmd)
+	cmd.run = func(args []string) error {
+		filter, err := selection.filter(cmd, args)
+		if err != nil {
+			return err
+		}
+		if client := dialDaemon(); client != nil {
+			return client.switchServer(filter)
+		}
+		err = locked(func() error { return switchServer(filter, nil, "switch") })
+		if err != nil {
+			emitEvent(failureEvent("switch", err))
+		}
+		return err
+	}
+	return cmd
+}
+
+// switchServer connects to the best server matching filter on the spare
+// interface, waits for its handshake and only then moves the priority 220
+// rule over, so that traffic never falls back to the main table. Servers in
+// avoid are skipped unless nothing else matches. reason is passed to hooks.
+func switchServer(filter serverFilter, avoid []string, reason string) error {
+	oldInterface := activeInterface()
+	if oldInterface == "" {
+		return fmt.Errorf("not connected, use 'norrvpn up'")
+	}
+	newInterface := tunnelInterfaces[0]
+	if oldInterface == newInterface {
+		newInterface = tunnelInterfaces[1]
+	}
+	if isWGInterfaceExists(newInterface) {
+		return fmt.Errorf("both %s and %s exist, run 'norrvpn down' first", oldInterface, newInterface)
+	}
+
+	current, _ := loadServerInfo()
+	servers, err := fetchServerList(filter, 20)
+	if err != nil {
+		return err
+	}
+	server := pickCandidate(servers, current.Hostname, avoid)
+	if server.Hostname == "" {
+		if len(servers) > 0 {
+			return fmt.Errorf("already connected to %s", current.Hostname)
+		}
+		return fmt.Errorf("no servers found for the specified criteria")
+	}
+	endpointIP, publicKey, err := serverEndpoint(server)
+	if err != nil {
+		return err
+	}
+	privateKey, err := ownPrivateKey()
+	if err != nil {
+		return err
+	}
+	oldEndpointIP := interfaceEndpoint(oldInterface)
+
+	fmt.Fprintf(output, "Switching to:\n")
+	displayServerInfo(server)
+	upHooks := hookInfo{iface: newInterface, server: server, endpoint: endpointIP, reason: reason}
+	downHooks := hookInfo{iface: oldInterface, server: current, endpoint: oldEndpointIP, reason: reason}
+	if err := runHooks(preUp, upHooks); err != nil {
+		return err
+	}
+	if err := runHooks(preDown, downHooks); err != nil {
+		return err
+	}
+	start := time.Now()
+
+	oldTable, newTable := routingTable(oldInterface), routingTable(newInterface)
+	// Until the old rule is gone, any failure removes what was set up for
+	// the new interface again, so that the old one stays the only tunnel.
+	var rollback []netOp
+	committed := false
+	defer func() {
+		if committed || *dryRunFlag {
+			return
+		}
+		slices.Reverse(rollback)
+		for _, o := range append(rollback,
+			newNetOp("ip", "route", "delete", "default", "dev", newInterface, "table", newTable),
+			newNetOp("ip", "link", "delete", "dev", newInterface)) {
+			o.exec()
+		}
+	}()
+
+	if err := apply(linkUpOps(newInterface, privateKey, publicKey, endpointIP, defaultNordvpnAddress)...); err != nil {
+		return fmt.Errorf("switching: %w", err)
+	}
+	if endpointIP != oldEndpointIP {
+		if err := apply(endpointRule("add", endpointIP)); err != nil {
+			return fmt.Errorf("switching: %w", err)
+		}
+		rollback = append(rollback, endpointRule("delete", endpointIP))
+	}
+	if *dryRunFlag {
+		fmt.Fprintf(output, "# wait up to %s for a handshake on %s\n", handshakeTimeout, newInterface)
+	} else if err := waitForHandshake(newInterface, handshakeTimeout); err != nil {
+		// The cached key may have been changed since it was fetched.
+		key, changed := renewPrivateKey()
+		if !changed {
+			return fmt.Errorf("switching: %w, staying on %s", err, current.Hostname)
+		}
+		slog.Info("retrying with the changed NordLynx key", "interface", newInterface)
+		if err := privateKeyOp(newInterface, key).exec(); err != nil {
+			return fmt.Errorf("switching: %w, staying on %s", err, current.Hostname)
+		}
+		if err := waitForHandshake(newInterface, handshakeTimeout); err != nil {
+			return fmt.Errorf("switching: %w, staying on %s", err, current.Hostname)
+		}
+	}
+
+	// Rules of equal priority are evaluated in insertion order, so the old
+	// rule keeps matching until it is deleted.
+	if err := apply(tunnelRule("add", newTable)); err != nil {
+		return fmt.Errorf("switching: %w", err)
+	}
+	rollback = append(rollback, tunnelRule("delete", newTable))
+	if err := apply(tunnelRule("delete", oldTable)); err != nil {
+		return fmt.Errorf("switching: %w", err)
+	}
+	committed = true
+	if !*dryRunFlag {
+		saveServerInfo(server)
+		saveServerFilter(filter)
+		recordServer(server.Hostname)
+		slog.Info("switched", "from", current.Hostname, "to", server.Hostname,
+			"interface", newInterface, "took", time.Since(start))
+		changed := serverEvent("server-changed", newInterface, server)
+		changed.Message = "from " + current.Hostname
+		emitEvent(changed)
+	}
+
+	// Traffic already uses the new tunnel; leftovers of the old one are
+	// reported but left to 'norrvpn repair'.
+	var cleanup []netOp
+	if endpointIP != oldEndpointIP && oldEndpointIP != "" {
+		cleanup = append(cleanup, endpointRule("delete", oldEndpointIP))
+	}
+	err = apply(append(cleanup, linkDownOps(oldInterface, defaultNordvpnAddress)...)...)
+	runHooks(postDown, downHooks)
+	runHooks(postUp, upHooks)
+	if err != nil {
+		return fmt.Errorf("removing %s: %w", oldInterface, err)
+	}
+	return nil
+}
+
+// pickCandidate returns the best server other than current, preferring ones
+// not in avoid.
+func pickCandidate(servers Servers, current string, avoid []string) Server {
+	var fallback Server
+	for _, candidate := range servers {
+		if candidate.Hostname == current {
+			continue
+		}
+		if !slices.Contains(avoid, candidate.Hostname) {
+			return candidate
+		}
+		if fallback.Hostname == "" {
+			fallback = candidate
+		}
+	}
+	return fallback
+}
@@ -8,7 +8,6 @@ import (
 	"strings"
 	"syscall"
 
-	"github.com/davecgh/go-spew/spew"
 	"golang.org/x/term"
 )
 
@@ -21,10 +20,6 @@ func panicer(err any) {
 	}
 }
 
-func dumper(v any) {
-	spew.Dump(v)
-}
-
 func getHomeDir() string {
 	if val, ok := os.LookupEnv("SUDO_HOME"); ok {
 		return val
@@ -54,3 +49,18 @@ func readSecretInput(message string) string {
 func trim(s string) string {
 	return strings.TrimSpace(s)
 }
+
+// writePrivateFile writes data readable by the owner only, also tightening
+// the mode of a file that already existed.
+func writePrivateFile(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := file.Chmod(0600); err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	return err
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// loadCheckInterval is how often the current server is re-queried for
+	// --max-load.
+	loadCheckInterval = 5 * time.Minute
+	// overloadChecks is how many checks in a row must exceed --max-load
+	// before moving, so that a short spike does not cause a switch.
+	overloadChecks = 3
+)
+
+// watchOptions configures the loop up keeps running in the foreground after
+// connecting.
+type watchOptions struct {
+	rotate  time.Duration
+	maxLoad int
+	metrics string // only used by watch, the daemon serves its own
+}
+
+func (o watchOptions) enabled() bool {
+	return o.rotate > 0 || o.maxLoad > 0
+}
+
+func (o watchOptions) String() string {
+	var parts []string
+	if o.rotate > 0 {
+		parts = append(parts, fmt.Sprintf("rotating servers every %s", o.rotate))
+	}
+	if o.maxLoad > 0 {
+		parts = append(parts, fmt.Sprintf("moving when the load stays above %d%%", o.maxLoad))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// watch acts on the tunnel in the foreground until interrupted. The
+// connection is left up when it returns.
+func watch(filter serverFilter, opts watchOptions) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := startMetrics(ctx, opts.metrics); err != nil {
+		return fmt.Errorf("metrics: %w", err)
+	}
+	fmt.Printf("Watching the connection: %s. Press Ctrl-C to stop (the connection stays up)\n", opts)
+	go monitorLoop(ctx, true)
+	go webhookLoop(ctx)
+	watchLoop(ctx, filter, opts)
+	return nil
+}
+
+// watchLoop runs until ctx is done. A failed step is logged and retried on
+// the next tick.
+func watchLoop(ctx context.Context, filter serverFilter, opts watchOptions) {
+	var rotate, loadCheck <-chan time.Time
+	if opts.rotate > 0 {
+		ticker := time.NewTicker(opts.rotate)
+		defer ticker.Stop()
+		rotate = ticker.C
+	}
+	if opts.maxLoad > 0 {
+		ticker := time.NewTicker(loadCheckInterval)
+		defer ticker.Stop()
+		loadCheck = ticker.C
+	}
+
+	overloaded := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-rotate:
+			slog.Info("rotating server", "interval", opts.rotate)
+			if err := locked(func() error { return switchServer(filter, recentServers(), "rotate") }); err != nil {
+				slog.Warn("rotation failed", "err", err)
+				emitEvent(failureEvent("rotate", err))
+			}
+			overloaded = 0
+		case <-loadCheck:
+			err := locked(func() error {
+				move, err := checkLoad(opts.maxLoad, &overloaded)
+				if err != nil || !move {
+					return err
+				}
+				overloaded = 0
+				filter, err := locationFilter(filter)
+				if err != nil {
+					return err
+				}
+				return switchServer(filter, nil, "overload")
+			})
+			if err != nil {
+				slog.Warn("load check failed", "err", err)
+				emitEvent(failureEvent("load check", err))
+			}
+		}
+	}
+}
+
+// checkLoad re-queries the current server and reports whether the tunnel
+// should move: right away when it is no longer online, or after its load
+// exceeded maxLoad overloadChecks times in a row.
+func checkLoad(maxLoad int, overloaded *int) (bool, error) {
+	current, err := loadServerInfo()
+	if err != nil {
+		return false, err
+	}
+	servers, err := fetchServerList(serverFilter{Hostname: current.Hostname}, 1)
+	if err != nil {
+		return false, err
+	}
+	if len(servers) == 0 {
+		slog.Warn("current server is no longer listed", "server", current.Hostname)
+		return true, nil
+	}
+	server := servers[0]
+	slog.Debug("load check", "server", server.Hostname, "load", server.Load, "status", server.Status)
+	if server.Status != "online" {
+		slog.Warn("current server is not online", "server", server.Hostname, "status", server.Status)
+		return true, nil
+	}
+	if server.Load <= maxLoad {
+		*overloaded = 0
+		return false, nil
+	}
+	*overloaded++
+	slog.Info("current server is overloaded", "server", server.Hostname, "load", server.Load,
+		"max_load", maxLoad, "checks", *overloaded)
+	return *overloaded >= overloadChecks, nil
+}
+
+// locationFilter returns the filter for a replacement of the current server:
+// filter itself when it names a country or city, otherwise the country and
+// city of the current server, keeping the group. Without a recorded location
+// it fails rather than look for a replacement anywhere.
+func locationFilter(filter serverFilter) (serverFilter, error) {
+	if filter.Hostname == "" && (filter.CountryID != 0 || filter.CityID != 0) {
+		return filter, nil
+	}
+	current, err := loadServerInfo()
+	if err != nil || len(current.Locations) == 0 {
+		return serverFilter{}, fmt.Errorf("the location of the current server is not recorded, run 'norrvpn switch' with a country")
+	}
+	country := current.Locations[0].Country
+	return serverFilter{CountryID: country.ID, CityID: country.City.ID, Group: filter.Group}, nil
+}
+
+// netMu serializes changes to the tunnel between the watch loop and daemon
+// requests; the lock file does the same between processes.
+var netMu sync.Mutex
+
+// locked runs f under netMu and the lock file, turning a panic from the
+// panicer style helpers into an error so that a long running process
+// survives it. A dry run changes nothing and takes no lock file.
+func locked(f func() error) (err error) {
+	netMu.Lock()
+	defer netMu.Unlock()
+	if !*dryRunFlag {
+		lock, err := acquireLock(*waitFlag)
+		if err != nil {
+			return err
+		}
+		defer lock.release()
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	return f()
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var webhookQueuePath = tokenPath + "/webhooks.queue"
+
+const (
+	webhookTimeout = 5 * time.Second
+	// webhookMaxAge is how long undelivered payloads are kept and retried.
+	webhookMaxAge   = 24 * time.Hour
+	webhookInterval = 30 * time.Second
+)
+
+// defaultWebhookEvents are sent when a webhook does not list its events.
+var defaultWebhookEvents = []string{"connected", "disconnected", "server-changed", "reconnecting", "failed"}
+
+// webhookConfig is an entry of "webhooks" in config.json.
+type webhookConfig struct {
+	URL string `json:"url"`
+	// Secret signs the payload, see signPayload.
+	Secret string   `json:"secret,omitempty"`
+	Events []string `json:"events,omitempty"`
+}
+
+func (w webhookConfig) wants(kind string) bool {
+	if len(w.Events) == 0 {
+		return slices.Contains(defaultWebhookEvents, kind)
+	}
+	return slices.Contains(w.Events, kind)
+}
+
+// webhookPayload is the JSON body sent to webhooks: the event and the
+// machine it happened on.
+type webhookPayload struct {
+	event
+	Machine string `json:"machine"`
+}
+
+// queuedWebhook is a payload waiting for delivery.
+type queuedWebhook struct {
+	URL      string          `json:"url"`
+	Body     json.RawMessage `json:"body"`
+	QueuedAt time.Time       `json:"queued_at"`
+	Attempts int             `json:"attempts"`
+}
+
+var (
+	webhookKick = make(chan struct{}, 1)
+	// webhooksQueued is set once this process queued a payload, so that
+	// commands that changed nothing do not wait for deliveries.
+	webhooksQueued atomic.Bool
+)
+
+// lockWebhookQueue takes an flock on the lock file of the queue, which the
+// daemon and CLI processes share. Without block it fails when the lock is
+// held. The returned function releases it.
+func lockWebhookQueue(block bool) (func(), error) {
+	if err := os.MkdirAll(tokenPath, 0700); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(webhookQueuePath+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	how := syscall.LOCK_EX
+	if !block {
+		how |= syscall.LOCK_NB
+	}
+	if err := syscall.Flock(int(file.Fd()), how); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return func() { file.Close() }, nil
+}
+
+// queueWebhooks stores e for every webhook that wants it. Delivery happens
+// in flushWebhooks, so that nothing is lost while offline.
+func queueWebhooks(e event) {
+	cfg, err := loadConfig()
+	if err != nil || len(cfg.Webhooks) == 0 {
+		return
+	}
+	machine, _ := os.Hostname()
+	body, err := json.Marshal(webhookPayload{event: e, Machine: machine})
+	if err != nil {
+		return
+	}
+
+	unlock, err := lockWebhookQueue(true)
+	if err != nil {
+		slog.Warn("webhook not queued", "err", err)
+		return
+	}
+	defer unlock()
+	queue := loadWebhookQueue()
+	for _, hook := range cfg.Webhooks {
+		if hook.wants(e.Type) {
+			queue = append(queue, queuedWebhook{URL: hook.URL, Body: body, QueuedAt: e.Time})
+		}
+	}
+	saveWebhookQueue(queue)
+	webhooksQueued.Store(true)
+	select {
+	case webhookKick <- struct{}{}:
+	default:
+	}
+}
+
+// flushWebhooks tries to deliver every queued payload once. Failed ones stay
+// queued until webhookMaxAge. When another process is flushing already, it
+// leaves the queue to that one.
+func flushWebhooks() {
+	cfg, err := loadConfig()
+	if err != nil {
+		return
+	}
+	unlock, err := lockWebhookQueue(false)
+	if err != nil {
+		return
+	}
+	defer unlock()
+	queue := loadWebhookQueue()
+	if len(queue) == 0 {
+		return
+	}
+
+	var remaining []queuedWebhook
+	for _, item := range queue {
+		i := slices.IndexFunc(cfg.Webhooks, func(w webhookConfig) bool { return w.URL == item.URL })
+		if i < 0 {
+			continue // no longer configured
+		}
+		err := sendWebhook(cfg.Webhooks[i], item.Body)
+		if err == nil {
+			slog.Debug("webhook delivered", "url", item.URL, "attempts", item.Attempts+1)
+			continue
+		}
+		item.Attempts++
+		if time.Since(item.QueuedAt) > webhookMaxAge {
+			slog.Warn("webhook dropped", "url", item.URL, "attempts", item.Attempts, "err", err)
+			continue
+		}
+		slog.Info("webhook failed, queued for retry", "url", item.URL, "attempts", item.Attempts, "err", err)
+		remaining = append(remaining, item)
+	}
+	saveWebhookQueue(remaining)
+}
+
+// webhookLoop retries queued payloads until ctx is done.
+func webhookLoop(ctx context.Context) {
+	ticker := time.NewTicker(webhookInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-webhookKick:
+		}
+		flushWebhooks()
+	}
+}
+
+// signPayload returns the X-Norrvpn-Signature value: the hex HMAC-SHA256
+// of the body keyed with the shared secret.
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func sendWebhook(hook webhookConfig, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "norrvpn")
+	if hook.Secret != "" {
+		req.Header.Set("X-Norrvpn-Signature", signPayload(hook.Secret, body))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
+
+func loadWebhookQueue() []queuedWebhook {
+	var queue []queuedWebhook
+	if data, err := os.ReadFile(webhookQueuePath); err == nil {
+		json.Unmarshal(data, &queue)
+	}
+	return queue
+}
+
+func saveWebhookQueue(queue []queuedWebhook) {
+	if len(queue) == 0 {
+		os.Remove(webhookQueuePath)
+		return
+	}
+	data, err := json.Marshal(queue)
+	if err != nil || os.MkdirAll(tokenPath, 0700) != nil {
+		return
+	}
+	writePrivateFile(webhookQueuePath, data)
+}
+
+func newWebhookCommand() *command {
+	cmd := newCommand("webhook", "test", "Send a test event to the configured webhooks")
+	cmd.minArgs, cmd.maxArgs = 1, 1
+	cmd.completeArgs = func(ctx *completionContext) []string {
+		if len(ctx.args) > 0 {
+			return nil
+		}
+		return []string{"test"}
+	}
+	cmd.run = func(args []string) error {
+		if args[0] != "test" {
+			return cmd.usagef("unknown webhook command %q", args[0])
+		}
+		cfg, err := loadConfig()
+		if err != nil {
+			return err
+		}
+		if len(cfg.Webhooks) == 0 {
+			return fmt.Errorf("no webhooks configured in %s", configPath)
+		}
+		machine, _ := os.Hostname()
+		e := event{Type: "test", Time: time.Now(), Message: "norrvpn webhook test"}
+		body, err := json.Marshal(webhookPayload{event: e, Machine: machine})
+		if err != nil {
+			return err
+		}
+		failed := 0
+		for _, hook := range cfg.Webhooks {
+			if err := sendWebhook(hook, body); err != nil {
+				fmt.Printf("%s: %v\n", hook.URL, err)
+				failed++
+				continue
+			}
+			fmt.Printf("%s: ok\n", hook.URL)
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d of %d webhooks failed", failed, len(cfg.Webhooks))
+		}
+		return nil
+	}
+	return cmd
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// useWebhookDir points tokenPath, the config and the queue at a temporary
+// directory with a config for url.
+func useWebhookDir(t *testing.T, url, secret string) {
+	t.Helper()
+	dir := t.TempDir()
+	oldToken, oldConfig, oldQueue := tokenPath, configPath, webhookQueuePath
+	tokenPath, configPath, webhookQueuePath = dir, filepath.Join(dir, "config.json"), filepath.Join(dir, "webhooks.queue")
+	t.Cleanup(func() { tokenPath, configPath, webhookQueuePath = oldToken, oldConfig, oldQueue })
+	config := `{"webhooks": [{"url": "` + url + `", "secret": "` + secret + `"}]}`
+	if err := os.WriteFile(configPath, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSignPayload(t *testing.T) {
+	// echo -n '{"type":"connected"}' | openssl dgst -sha256 -hmac secret
+	const want = "sha256=932e284e2d015af9c27ee493c8cb9dd74dec84abdc300cb4ec93b9c7fd3c1fea"
+	if got := signPayload("secret", []byte(`{"type":"connected"}`)); got != want {
+		t.Errorf("signPayload = %s, want %s", got, want)
+	}
+}
+
+func TestSendWebhook(t *testing.T) {
+	body := []byte(`{"type":"connected"}`)
+	var gotSignature, gotType string
+	var gotBody []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotSignature = r.Header.Get("X-Norrvpn-Signature")
+		gotType = r.Header.Get("Content-Type")
+		gotBody, _ = io.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	if err := sendWebhook(webhookConfig{URL: server.URL, Secret: "secret"}, body); err != nil {
+		t.Fatal(err)
+	}
+	if gotSignature != signPayload("secret", body) {
+		t.Errorf("signature = %q, want %q", gotSignature, signPayload("secret", body))
+	}
+	if gotType != "application/json" {
+		t.Errorf("Content-Type = %q", gotType)
+	}
+	if string(gotBody) != string(body) {
+		t.Errorf("body = %s, want %s", gotBody, body)
+	}
+}
+
+func TestSendWebhookRejected(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	if err := sendWebhook(webhookConfig{URL: server.URL}, []byte("{}")); err == nil {
+		t.Error("sendWebhook succeeded on a 500 answer")
+	}
+}
+
+func TestFlushWebhooksRetries(t *testing.T) {
+	var fail atomic.Bool
+	var delivered atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		delivered.Add(1)
+	}))
+	defer server.Close()
+	useWebhookDir(t, server.URL, "secret")
+
+	fail.Store(true)
+	queueWebhooks(event{Type: "connected", Time: time.Now(), Server: "se1.nordvpn.com"})
+	flushWebhooks()
+	queue := loadWebhookQueue()
+	if len(queue) != 1 {
+		t.Fatalf("queue has %d entries after a failed send, want 1", len(queue))
+	}
+	if queue[0].Attempts != 1 {
+		t.Errorf("attempts = %d, want 1", queue[0].Attempts)
+	}
+
+	fail.Store(false)
+	flushWebhooks()
+	if n := delivered.Load(); n != 1 {
+		t.Errorf("delivered %d times, want 1", n)
+	}
+	if queue := loadWebhookQueue(); len(queue) != 0 {
+		t.Errorf("queue has %d entries after delivery, want 0", len(queue))
+	}
+}
+
+func TestQueueWebhooksFiltersEvents(t *testing.T) {
+	useWebhookDir(t, "http://127.0.0.1:1", "")
+	queueWebhooks(event{Type: "traffic", Time: time.Now()})
+	if queue := loadWebhookQueue(); len(queue) != 0 {
+		t.Errorf("queued %d traffic events, want none by default", len(queue))
+	}
+	queueWebhooks(event{Type: "failed", Time: time.Now()})
+	if queue := loadWebhookQueue(); len(queue) != 1 {
+		t.Errorf("queued %d failed events, want 1", len(queue))
+	}
+}